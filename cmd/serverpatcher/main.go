@@ -2,16 +2,19 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"os"
 	"os/signal"
 	"syscall"
+	"text/tabwriter"
 	"time"
 
 	"github.com/serverpatcher/serverpatcher/internal/app"
 	"github.com/serverpatcher/serverpatcher/internal/config"
 	"github.com/serverpatcher/serverpatcher/internal/logging"
+	"github.com/serverpatcher/serverpatcher/internal/plan"
 	"github.com/serverpatcher/serverpatcher/internal/version"
 )
 
@@ -26,13 +29,32 @@ func main() {
 		fmt.Println(version.VersionString())
 		return
 	case "detect":
-		info, backend, err := app.Detect()
+		// The config is optional here: it only supplies patching.backend.
+		cfgPath := parseConfigFlag("detect", os.Args[2:])
+		backend := "auto"
+		if _, err := os.Stat(cfgPath); err == nil {
+			cfg, err := config.Load(cfgPath)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			backend = cfg.Patching.Backend
+		}
+		info, sel, err := app.Detect(backend)
 		if err != nil {
 			fmt.Fprintln(os.Stderr, err)
 			os.Exit(1)
 		}
-		fmt.Printf("os=%s\nid=%s\nversion=%s\npretty=%s\nbackend=%s\n",
-			info.Name, info.ID, info.VersionID, info.PrettyName, backend)
+		fmt.Printf("os=%s\nid=%s\nversion=%s\npretty=%s\nbackend=%s\nreason=%s\n",
+			info.Name, info.ID, info.VersionID, info.PrettyName, sel.Patcher.Name(), sel.Reason)
+		fmt.Println("considered:")
+		for _, c := range sel.Candidates {
+			binary := c.Binary
+			if binary == "" {
+				binary = "not installed"
+			}
+			fmt.Printf("  %-7s score=%d os_match=%v binary=%s\n", c.Backend, c.Score, c.OSMatch, binary)
+		}
 		return
 	case "print-default-config":
 		s := flag.NewFlagSet("print-default-config", flag.ExitOnError)
@@ -54,8 +76,8 @@ func main() {
 		}
 		fmt.Println("OK")
 		return
-	case "run-once":
-		cfgPath, verbose := parseConfigAndVerbose("run-once", os.Args[2:])
+	case "run-once", "download", "install":
+		cfgPath, verbose := parseConfigAndVerbose(os.Args[1], os.Args[2:])
 		cfg, err := config.Load(cfgPath)
 		if err != nil {
 			fmt.Fprintln(os.Stderr, err)
@@ -73,7 +95,14 @@ func main() {
 		defer cancel()
 
 		a := app.New(cfg, log)
-		rep, err := a.RunOnce(ctx)
+		run := a.RunOnce
+		switch os.Args[1] {
+		case "download":
+			run = a.Download
+		case "install":
+			run = a.Install
+		}
+		rep, err := run(ctx)
 		if err != nil {
 			fmt.Fprintln(os.Stderr, err)
 			os.Exit(1)
@@ -81,6 +110,199 @@ func main() {
 		fmt.Printf("status=%s patched=%v reboot_required=%v duration=%s report=%s\n",
 			rep.Status, rep.Patched, rep.RebootRequired, rep.Duration.Round(time.Second), rep.ReportPath)
 		return
+	case "list-updates":
+		fs := flag.NewFlagSet("list-updates", flag.ExitOnError)
+		cfgPath := fs.String("config", "/etc/serverpatcher/config.json", "config file path")
+		asJSON := fs.Bool("json", false, "print JSON instead of a table")
+		_ = fs.Parse(os.Args[2:])
+		cfg, err := config.Load(*cfgPath)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		log, closeFn, err := logging.New(cfg.Logging)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		defer closeFn()
+
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.ServerTimeout)
+		defer cancel()
+
+		a := app.New(cfg, log)
+		backend, ups, err := a.ListUpdates(ctx)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if *asJSON {
+			out := map[string]any{"backend": backend, "updates": ups}
+			b, _ := json.MarshalIndent(out, "", "  ")
+			fmt.Println(string(b))
+			return
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAME\tARCH\tCURRENT\tCANDIDATE\tREPOSITORY\tSECURITY")
+		for _, u := range ups {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%v\n", u.Name, u.Arch, u.Current, u.Candidate, u.Repository, u.Security)
+		}
+		_ = tw.Flush()
+		fmt.Printf("backend=%s pending=%d\n", backend, len(ups))
+		return
+	case "patch-packages":
+		fs := flag.NewFlagSet("patch-packages", flag.ExitOnError)
+		cfgPath := fs.String("config", "/etc/serverpatcher/config.json", "config file path")
+		verbose := fs.Bool("verbose", false, "also log to stdout")
+		_ = fs.Parse(os.Args[2:])
+		if fs.NArg() == 0 {
+			fmt.Fprintln(os.Stderr, "patch-packages: name at least one package (globs allowed)")
+			os.Exit(2)
+		}
+		cfg, err := config.Load(*cfgPath)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		cfg.Logging.AlsoStdout = cfg.Logging.AlsoStdout || *verbose
+		log, closeFn, err := logging.New(cfg.Logging)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		defer closeFn()
+
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.ServerTimeout)
+		defer cancel()
+
+		a := app.New(cfg, log)
+		rep, err := a.PatchPackages(ctx, fs.Args())
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Printf("status=%s patched=%v reboot_required=%v duration=%s report=%s\n",
+			rep.Status, rep.Patched, rep.RebootRequired, rep.Duration.Round(time.Second), rep.ReportPath)
+		return
+	case "plan":
+		fs := flag.NewFlagSet("plan", flag.ExitOnError)
+		cfgPath := fs.String("config", "/etc/serverpatcher/config.json", "config file path")
+		out := fs.String("out", "plan.json", "where to write the plan")
+		_ = fs.Parse(os.Args[2:])
+		cfg, err := config.Load(*cfgPath)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		log, closeFn, err := logging.New(cfg.Logging)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		defer closeFn()
+
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.ServerTimeout)
+		defer cancel()
+
+		a := app.New(cfg, log)
+		pl, err := a.Plan(ctx)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if err := plan.Write(*out, pl); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "BACKEND\tNAME\tARCH\tCURRENT\tTARGET")
+		for _, b := range pl.Backends {
+			for _, u := range b.Packages {
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", b.Backend, u.Name, u.Arch, u.Current, u.Candidate)
+			}
+		}
+		_ = tw.Flush()
+		fmt.Printf("plan=%s algorithm=%s host=%s\n", *out, pl.Algorithm, pl.Host.Hostname)
+		return
+	case "apply":
+		fs := flag.NewFlagSet("apply", flag.ExitOnError)
+		cfgPath := fs.String("config", "/etc/serverpatcher/config.json", "config file path")
+		planPath := fs.String("plan", "", "plan file written by `serverpatcher plan`")
+		verbose := fs.Bool("verbose", false, "also log to stdout")
+		_ = fs.Parse(os.Args[2:])
+		if *planPath == "" {
+			fmt.Fprintln(os.Stderr, "apply: --plan is required")
+			os.Exit(2)
+		}
+		cfg, err := config.Load(*cfgPath)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		cfg.Logging.AlsoStdout = cfg.Logging.AlsoStdout || *verbose
+		log, closeFn, err := logging.New(cfg.Logging)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		defer closeFn()
+
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.ServerTimeout)
+		defer cancel()
+
+		a := app.New(cfg, log)
+		rep, err := a.Apply(ctx, *planPath)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Printf("status=%s patched=%v reboot_required=%v duration=%s report=%s\n",
+			rep.Status, rep.Patched, rep.RebootRequired, rep.Duration.Round(time.Second), rep.ReportPath)
+		return
+	case "rollback":
+		fs := flag.NewFlagSet("rollback", flag.ExitOnError)
+		cfgPath := fs.String("config", "/etc/serverpatcher/config.json", "config file path")
+		reportPath := fs.String("report", "", "run report whose pre-patch versions to restore")
+		dryRun := fs.Bool("dry-run", false, "only simulate the rollback")
+		verbose := fs.Bool("verbose", false, "also log to stdout")
+		_ = fs.Parse(os.Args[2:])
+		if *reportPath == "" {
+			fmt.Fprintln(os.Stderr, "rollback: --report is required")
+			os.Exit(2)
+		}
+		cfg, err := config.Load(*cfgPath)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		cfg.Logging.AlsoStdout = cfg.Logging.AlsoStdout || *verbose
+		log, closeFn, err := logging.New(cfg.Logging)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		defer closeFn()
+
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.ServerTimeout)
+		defer cancel()
+
+		a := app.New(cfg, log)
+		rep, err := a.Rollback(ctx, *reportPath, *dryRun)
+		if rep != nil && rep.Rollback != nil {
+			for _, t := range rep.Rollback.Targets {
+				fmt.Printf("restore %s %s\n", t.Name, t.Version)
+			}
+			for _, c := range rep.Rollback.Skipped {
+				fmt.Printf("skip    %s (%s %s)\n", c.Name, c.Action, c.NewVersion)
+			}
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Printf("status=%s dry_run=%v duration=%s report=%s\n",
+			rep.Status, *dryRun || cfg.Patching.DryRun, rep.Duration.Round(time.Second), rep.ReportPath)
+		return
 	case "daemon":
 		cfgPath, verbose := parseConfigAndVerbose("daemon", os.Args[2:])
 		cfg, err := config.Load(cfgPath)
@@ -139,8 +361,15 @@ func usage() {
 Usage: serverpatcher <command> [--config path] [--verbose]
 Commands:
   run-once               Apply patches once and exit
+  download               Fetch the packages a run would install, without installing
+  install                Install from the packages fetched by download
   daemon                 Run continuously on an interval
-  detect                 Print detected OS and selected backend
+  list-updates           List pending package updates (--json for JSON)
+  patch-packages         Upgrade only the named packages, e.g. 'openssl*' sudo
+  plan                   Write the updates a run would install to a sealed plan file (--out file)
+  apply                  Install exactly the versions in a plan file (--plan file)
+  rollback               Restore pre-patch versions from a run report (--report file [--dry-run])
+  detect                 Print detected OS, selected backend and why
   validate-config        Validate config and exit
   print-default-config   Print default config JSON to stdout
   version                Print version`)
@@ -8,6 +8,7 @@ import (
 	"math/rand"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
@@ -18,7 +19,10 @@ import (
 	"github.com/serverpatcher/serverpatcher/internal/lock"
 	"github.com/serverpatcher/serverpatcher/internal/osinfo"
 	"github.com/serverpatcher/serverpatcher/internal/patcher"
+	"github.com/serverpatcher/serverpatcher/internal/preflight"
 	"github.com/serverpatcher/serverpatcher/internal/report"
+	"github.com/serverpatcher/serverpatcher/internal/services"
+	"github.com/serverpatcher/serverpatcher/internal/snapshot"
 )
 
 type App struct {
@@ -36,20 +40,22 @@ func New(cfg *config.Parsed, log *slog.Logger) *App {
 	return a
 }
 
-func Detect() (*osinfo.Info, string, error) {
+// Detect reports the OS and how the backend would be chosen for it.
+// backend is the patching.backend setting ("auto" or a backend name).
+func Detect(backend string) (*osinfo.Info, *patcher.Selection, error) {
 	info, err := osinfo.Detect()
 	if err != nil {
-		return nil, "", err
+		return nil, nil, err
 	}
-	p, err := patcher.Select(info)
+	sel, err := patcher.Select(info, backend)
 	if err != nil {
-		return info, "", err
+		return info, nil, err
 	}
-	return info, p.Name(), nil
+	return info, sel, nil
 }
 
 func (a *App) RunService(ctx context.Context) error {
-	a.log.Info("starting service loop", "interval", a.cfg.ServerInterval.String(), "jitter", a.cfg.ServerJitter.String())
+	a.log.Info("starting service loop", "interval", a.cfg.ServerInterval.String(), "jitter", a.cfg.ServerJitter.String(), "windows", a.cfg.Server.Windows)
 
 	if a.health != nil {
 		go func() {
@@ -59,18 +65,72 @@ func (a *App) RunService(ctx context.Context) error {
 		}()
 	}
 
+	due := time.Now()
 	for {
-		select {
-		case <-ctx.Done():
+		// With maintenance windows, a run due outside of them moves to the
+		// next window, jittered within its first half.
+		var windowEnd time.Time
+		if start, end, ok := a.cfg.Windows.Next(due); ok {
+			if start.After(due) {
+				due = start
+				if span := minDuration(a.cfg.ServerJitter, end.Sub(start)/2); span > 0 {
+					due = due.Add(time.Duration(rand.Int63n(int64(span))))
+				}
+			}
+			windowEnd = end
+			a.log.Info("next maintenance window", "start", start, "end", end)
+			if a.health != nil {
+				a.health.SetNextWindow(start, end)
+			}
+		}
+
+		// downloaded is set when the download phase ran ahead of this run,
+		// so the run only has to install.
+		downloaded := false
+		if ahead := a.cfg.DownloadAhead; ahead > 0 && ahead < time.Until(due) {
+			a.log.Info("sleeping until download phase", "sleep", (time.Until(due) - ahead).String())
+			if !sleepUntil(ctx, due.Add(-ahead)) {
+				return nil
+			}
+			dlCtx, cancel := context.WithTimeout(ctx, a.cfg.ServerTimeout)
+			rep, err := a.Download(dlCtx)
+			cancel()
+			if err != nil {
+				a.log.Error("download phase failed; next run downloads itself", "err", err)
+			} else {
+				a.log.Info("download phase completed", "report", rep.ReportPath)
+				downloaded = true
+			}
+		}
+		if sleep := time.Until(due); sleep > 0 {
+			a.log.Info("sleeping until next run", "sleep", sleep.Round(time.Second).String())
+		}
+		if !sleepUntil(ctx, due) {
 			a.log.Info("service loop stopped")
 			return nil
-		default:
 		}
 
+		run := a.RunOnce
+		if downloaded {
+			run = a.Install
+		}
 		runCtx, cancel := context.WithTimeout(ctx, a.cfg.ServerTimeout)
-		rep, err := a.RunOnce(runCtx)
+		if !windowEnd.IsZero() {
+			runCtx = withWindowEnd(runCtx, windowEnd)
+		}
+		rep, err := run(runCtx)
 		cancel()
 
+		due = time.Now().Add(a.cfg.ServerInterval)
+		if a.cfg.ServerJitter > 0 {
+			due = due.Add(time.Duration(rand.Int63n(int64(a.cfg.ServerJitter))))
+		}
+		if rep != nil && rep.Reason == report.ReasonWindowClosing {
+			a.log.Info("run deferred to the next maintenance window", "window_end", windowEnd)
+			due = windowEnd
+			continue
+		}
+
 		if rep != nil {
 			a.log.Info("run completed", "status", rep.Status, "patched", rep.Patched, "reboot_required", rep.RebootRequired, "report", rep.ReportPath)
 			if a.health != nil {
@@ -80,30 +140,123 @@ func (a *App) RunService(ctx context.Context) error {
 		if err != nil {
 			a.log.Error("run failed", "err", err)
 		}
+	}
+}
 
-		sleep := a.cfg.ServerInterval
-		if a.cfg.ServerJitter > 0 {
-			j := time.Duration(rand.Int63n(int64(a.cfg.ServerJitter)))
-			sleep = sleep + j
-		}
-		a.log.Info("sleeping until next run", "sleep", sleep.String())
-		select {
-		case <-ctx.Done():
-			return nil
-		case <-time.After(sleep):
-		}
+// sleepUntil waits until t; it returns false if ctx ends first.
+func sleepUntil(ctx context.Context, t time.Time) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(time.Until(t)):
+		return true
 	}
 }
 
+func minDuration(a, b time.Duration) time.Duration {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+type windowEndKey struct{}
+
+// withWindowEnd marks a run as started in a maintenance window ending at
+// end: it does not start package steps with less than server.window_reserve
+// left, but lets steps already running finish.
+func withWindowEnd(ctx context.Context, end time.Time) context.Context {
+	return context.WithValue(ctx, windowEndKey{}, end)
+}
+
+func windowEndFrom(ctx context.Context) (time.Time, bool) {
+	end, ok := ctx.Value(windowEndKey{}).(time.Time)
+	return end, ok
+}
+
 func (a *App) RunOnce(ctx context.Context) (*report.Report, error) {
+	return a.run(ctx, job{
+		// An allow-list run is about the named packages only.
+		secondary: len(a.cfg.Patching.IncludePackages) == 0,
+		patch: func(ctx context.Context, p patcher.Patcher, opt patcher.Options) patcher.SourceResult {
+			return patcher.RunSource(ctx, p, opt)
+		},
+	})
+}
+
+// Download runs the download phase: it refreshes metadata and fetches the
+// packages a run would install, without hooks, snapshot or installing
+// anything. Install later installs from that cache.
+func (a *App) Download(ctx context.Context) (*report.Report, error) {
+	return a.run(ctx, job{
+		operation: "download",
+		phase:     patcher.PhaseDownload,
+		patch: func(ctx context.Context, p patcher.Patcher, opt patcher.Options) patcher.SourceResult {
+			return patcher.RunSource(ctx, p, opt)
+		},
+	})
+}
+
+// Install runs the install phase: a regular run that installs from the
+// package cache filled by Download instead of refreshing metadata.
+func (a *App) Install(ctx context.Context) (*report.Report, error) {
+	return a.run(ctx, job{
+		operation: "install",
+		phase:     patcher.PhaseInstall,
+		secondary: len(a.cfg.Patching.IncludePackages) == 0,
+		patch: func(ctx context.Context, p patcher.Patcher, opt patcher.Options) patcher.SourceResult {
+			return patcher.RunSource(ctx, p, opt)
+		},
+	})
+}
+
+// PatchPackages upgrades only the installed packages matching patterns,
+// with the same locking, hooks, snapshot and reporting as RunOnce.
+func (a *App) PatchPackages(ctx context.Context, patterns []string) (*report.Report, error) {
+	return a.run(ctx, job{
+		operation: "patch-packages",
+		include:   patterns,
+		patch: func(ctx context.Context, p patcher.Patcher, opt patcher.Options) patcher.SourceResult {
+			return patcher.RunSource(ctx, p, opt)
+		},
+	})
+}
+
+// job is what one pass through the patch pipeline does with the selected
+// backend. The lock, hooks, snapshot, service handling and report around
+// it are the same for every operation.
+type job struct {
+	operation string
+	// check runs after backend selection and before the pre-hook; an
+	// error aborts the run.
+	check func(ctx context.Context, rep *report.Report, p patcher.Patcher) error
+	patch func(ctx context.Context, p patcher.Patcher, opt patcher.Options) patcher.SourceResult
+	// include overrides patching.include_packages.
+	include []string
+	// phase limits the backend to downloading or installing. A download
+	// changes nothing, so it runs without hooks, snapshot, service
+	// handling or reboot.
+	phase patcher.Phase
+	// secondary also patches patching.secondary_sources.
+	secondary bool
+	// pinned jobs install exact versions, which patching.min_package_age
+	// does not hold back.
+	pinned bool
+}
+
+func (a *App) run(ctx context.Context, j job) (*report.Report, error) {
 	start := time.Now()
 	host, _ := os.Hostname()
 
 	rep := &report.Report{
-		App:      "Server Patcher",
-		Hostname: host,
-		Started:  start,
-		Status:   report.StatusFailed,
+		App:       "Server Patcher",
+		Operation: j.operation,
+		Hostname:  host,
+		Started:   start,
+		Status:    report.StatusFailed,
 	}
 
 	lk, err := lock.Acquire(a.cfg.Server.LockFile)
@@ -129,7 +282,7 @@ func (a *App) RunOnce(ctx context.Context) (*report.Report, error) {
 	}
 	rep.OS = info
 
-	p, err := patcher.Select(info)
+	sel, err := patcher.Select(info, a.cfg.Patching.Backend)
 	if err != nil {
 		rep.Error = err.Error()
 		rep.Ended = time.Now()
@@ -137,10 +290,71 @@ func (a *App) RunOnce(ctx context.Context) (*report.Report, error) {
 		_ = a.finalize(rep)
 		return rep, err
 	}
+	p := sel.Patcher
 	rep.Backend = p.Name()
+	a.log.Info("backend selected", "backend", p.Name(), "reason", sel.Reason)
+
+	// Refuse an allow-list the backend cannot honour before any hook,
+	// snapshot or recovery touches the host.
+	include := a.cfg.Patching.IncludePackages
+	if j.include != nil {
+		include = j.include
+	}
+	if err := patcher.CheckInclude(p.Name(), include); err != nil {
+		rep.Error = err.Error()
+		rep.Ended = time.Now()
+		rep.Duration = rep.Ended.Sub(rep.Started)
+		_ = a.finalize(rep)
+		return rep, err
+	}
+
+	if j.check != nil {
+		if err := j.check(ctx, rep, p); err != nil {
+			rep.Error = err.Error()
+			rep.Ended = time.Now()
+			rep.Duration = rep.Ended.Sub(rep.Started)
+			_ = a.finalize(rep)
+			return rep, err
+		}
+	}
+
+	if a.cfg.Preflight.Enabled {
+		if err := a.preflight(ctx, rep, p.Name()); err != nil {
+			rep.Status = report.StatusSkipped
+			rep.Reason = report.ReasonPreflightFailed
+			rep.Error = err.Error()
+			rep.Ended = time.Now()
+			rep.Duration = rep.Ended.Sub(rep.Started)
+			_ = a.finalize(rep)
+			return rep, err
+		}
+	}
+
+	if err := a.waitForPackageLocks(ctx, rep, p.Name()); err != nil {
+		rep.Status = report.StatusSkipped
+		rep.Error = err.Error()
+		rep.Ended = time.Now()
+		rep.Duration = rep.Ended.Sub(rep.Started)
+		_ = a.finalize(rep)
+		return rep, err
+	}
+
+	window := j.phase != patcher.PhaseDownload
+
+	windowEnd, windowed := windowEndFrom(ctx)
+	if window && windowed && time.Until(windowEnd) < a.cfg.WindowReserve {
+		err := fmt.Errorf("maintenance window ends at %s, less than server.window_reserve (%s) away", windowEnd.Format(time.RFC3339), a.cfg.WindowReserve)
+		rep.Status = report.StatusSkipped
+		rep.Reason = report.ReasonWindowClosing
+		rep.Error = err.Error()
+		rep.Ended = time.Now()
+		rep.Duration = rep.Ended.Sub(rep.Started)
+		_ = a.finalize(rep)
+		return rep, err
+	}
 
 	// pre-hook
-	if strings.TrimSpace(a.cfg.Patching.PreHook) != "" {
+	if window && strings.TrimSpace(a.cfg.Patching.PreHook) != "" {
 		st, hookErr := a.runHook(ctx, "pre_hook", a.cfg.Patching.PreHook)
 		rep.Steps = append(rep.Steps, st)
 		if hookErr != nil {
@@ -152,27 +366,89 @@ func (a *App) RunOnce(ctx context.Context) (*report.Report, error) {
 		}
 	}
 
+	var snapProv snapshot.Provider
+	var snap *snapshot.Snapshot
+	if window {
+		if snapProv, snap, err = a.takeSnapshot(ctx, rep); err != nil {
+			rep.Error = err.Error()
+			rep.Ended = time.Now()
+			rep.Duration = rep.Ended.Sub(rep.Started)
+			_ = a.finalize(rep)
+			return rep, err
+		}
+	}
+
 	patchCtx, cancel := context.WithTimeout(ctx, a.cfg.PackageTimeout)
 	defer cancel()
 
-	opt := patcher.Options{
-		DryRun:          a.cfg.Patching.DryRun,
-		SecurityOnly:    a.cfg.Patching.SecurityOnly,
-		ExcludePackages: a.cfg.Patching.ExcludePackages,
-		AllowKernel:     a.cfg.Patching.AllowKernel,
-		Timeout:         a.cfg.PackageTimeout,
-		Nice:            a.cfg.Patching.CommandNice,
-		Ionice:          a.cfg.Patching.CommandIonice,
+	opt := a.patchOptions()
+	opt.IncludePackages = include
+	rep.IncludePackages = opt.IncludePackages
+	// A dry run simulates the whole run whatever the phase.
+	if !opt.DryRun {
+		opt.Phase = j.phase
+	}
+	// Finish whatever an interrupted earlier run left behind; the backend
+	// would fail on it otherwise.
+	if rc, ok := p.(patcher.Recoverer); ok && window && !opt.DryRun {
+		steps, err := rc.Recover(patchCtx, opt)
+		rep.Steps = append(rep.Steps, steps...)
+		if err != nil {
+			err = fmt.Errorf("recovering an interrupted package transaction failed: %w", err)
+			a.settleSnapshot(rep, snapProv, snap, false)
+			rep.Error = err.Error()
+			rep.Ended = time.Now()
+			rep.Duration = rep.Ended.Sub(rep.Started)
+			_ = a.finalize(rep)
+			return rep, err
+		}
 	}
 
-	patchRes, patchErr := p.Patch(patchCtx, opt)
+	if a.cfg.MinPackageAge > 0 && !j.pinned {
+		if err := a.quarantine(patchCtx, rep, p, &opt); err != nil {
+			err = fmt.Errorf("package age check failed: %w", err)
+			a.settleSnapshot(rep, snapProv, snap, false)
+			rep.Error = err.Error()
+			rep.Ended = time.Now()
+			rep.Duration = rep.Ended.Sub(rep.Started)
+			_ = a.finalize(rep)
+			return rep, err
+		}
+	}
+
+	primary := j.patch(patchCtx, p, opt)
+	if primary.SnapshotErr != nil {
+		a.log.Warn("could not snapshot installed packages; changes will not be reported", "err", primary.SnapshotErr)
+	}
+	patchRes, patchErr := primary.Result, primary.Err
+	rep.Changes = primary.Changes
 	if patchRes != nil {
 		rep.Patched = patchRes.Patched
 		rep.RebootRequired = patchRes.RebootRequired
 		rep.RebootReason = patchRes.RebootReason
+		rep.AppliedPatches = patchRes.AppliedPatches
+		rep.SecurityFilter = patchRes.SecurityFilter
+		rep.Plan = patchRes.Plan
 		rep.Steps = append(rep.Steps, patchRes.Steps...)
 	}
+	if a.cfg.Patching.Advisories {
+		// The lookup only adds report data; it must not hold a run past
+		// the end of its maintenance window.
+		advCtx, cancelAdv := context.WithCancel(ctx)
+		if windowed {
+			advCtx, cancelAdv = context.WithDeadline(ctx, windowEnd)
+		}
+		a.attachAdvisories(advCtx, rep, p, opt)
+		cancelAdv()
+	}
+	// Secondary sources run even if the distro backend failed; each one
+	// succeeds or fails on its own.
+	if j.secondary {
+		a.runSecondarySources(ctx, rep)
+	}
+
 	if patchErr != nil {
+		a.settleSnapshot(rep, snapProv, snap, false)
 		rep.Error = patchErr.Error()
 		rep.Ended = time.Now()
 		rep.Duration = rep.Ended.Sub(rep.Started)
@@ -180,11 +456,24 @@ func (a *App) RunOnce(ctx context.Context) (*report.Report, error) {
 		return rep, patchErr
 	}
 
+	if window && a.cfg.Patching.Cleanup.Enabled && !opt.DryRun {
+		if windowed && time.Until(windowEnd) < a.cfg.WindowReserve {
+			a.log.Warn("skipping cleanup: maintenance window is closing", "window_end", windowEnd)
+		} else {
+			a.cleanup(ctx, rep, p, opt)
+		}
+	}
+
+	if window && a.cfg.Patching.ServiceRestartPolicy != "none" && rep.Patched && !a.cfg.Patching.DryRun {
+		a.handleServices(ctx, rep)
+	}
+
 	// post-hook
-	if strings.TrimSpace(a.cfg.Patching.PostHook) != "" {
+	if window && strings.TrimSpace(a.cfg.Patching.PostHook) != "" {
 		st, hookErr := a.runHook(ctx, "post_hook", a.cfg.Patching.PostHook)
 		rep.Steps = append(rep.Steps, st)
 		if hookErr != nil {
+			a.settleSnapshot(rep, snapProv, snap, false)
 			rep.Error = hookErr.Error()
 			rep.Ended = time.Now()
 			rep.Duration = rep.Ended.Sub(rep.Started)
@@ -193,7 +482,14 @@ func (a *App) RunOnce(ctx context.Context) (*report.Report, error) {
 		}
 	}
 
+	a.settleSnapshot(rep, snapProv, snap, true)
+
 	rep.Status = report.StatusSuccess
+	for _, src := range rep.Sources {
+		if src.Status == report.StatusFailed {
+			rep.Status = report.StatusPartial
+		}
+	}
 	rep.Ended = time.Now()
 	rep.Duration = rep.Ended.Sub(rep.Started)
 
@@ -201,7 +497,7 @@ func (a *App) RunOnce(ctx context.Context) (*report.Report, error) {
 		return rep, err
 	}
 
-	if rep.RebootRequired && a.cfg.Patching.RebootPolicy == "reboot" && !a.cfg.Patching.DryRun {
+	if window && rep.RebootRequired && a.cfg.Patching.RebootPolicy == "reboot" && !a.cfg.Patching.DryRun {
 		a.log.Warn("reboot policy is reboot and reboot is required; attempting reboot")
 		_ = a.requestReboot(context.Background())
 	}
@@ -209,6 +505,306 @@ func (a *App) RunOnce(ctx context.Context) (*report.Report, error) {
 	return rep, nil
 }
 
+// ListUpdates reports what the selected backend would upgrade without
+// changing the host.
+func (a *App) ListUpdates(ctx context.Context) (string, []patcher.PendingUpdate, error) {
+	info, err := osinfo.Detect()
+	if err != nil {
+		return "", nil, err
+	}
+	sel, err := patcher.Select(info, a.cfg.Patching.Backend)
+	if err != nil {
+		return "", nil, err
+	}
+	ups, err := sel.Patcher.ListUpdates(ctx, a.patchOptions())
+	return sel.Patcher.Name(), ups, err
+}
+
+func (a *App) patchOptions() patcher.Options {
+	return patcher.Options{
+		DryRun:          a.cfg.Patching.DryRun,
+		SecurityOnly:    a.cfg.Patching.SecurityOnly,
+		MinSeverity:     a.cfg.Patching.MinSeverity,
+		ExcludePackages: a.cfg.Patching.ExcludePackages,
+		IncludePackages: a.cfg.Patching.IncludePackages,
+		AllowKernel:     a.cfg.Patching.AllowKernel,
+		Timeout:         a.cfg.PackageTimeout,
+		Nice:            a.cfg.Patching.CommandNice,
+		Ionice:          a.cfg.Patching.CommandIonice,
+	}
+}
+
+// attachAdvisories looks up the advisories fixed by the run's changes, or
+// by the plan in a dry run, and records them per package. Lookup failures
+// only cost the CVE data.
+func (a *App) attachAdvisories(ctx context.Context, rep *report.Report, p patcher.Patcher, opt patcher.Options) {
+	al, ok := p.(patcher.AdvisoryLister)
+	changes := rep.Changes
+	if opt.DryRun {
+		changes = rep.Plan
+	}
+	if !ok || len(changes) == 0 {
+		return
+	}
+	advs, err := al.Advisories(ctx, changes, opt)
+	if err != nil {
+		a.log.Warn("could not look up security advisories", "err", err)
+	}
+	patcher.AttachAdvisories(changes, advs)
+	seen := map[string]bool{}
+	for _, c := range changes {
+		for _, cve := range c.CVEs {
+			if !seen[cve] {
+				seen[cve] = true
+				rep.CVEs = append(rep.CVEs, cve)
+			}
+		}
+	}
+	sort.Strings(rep.CVEs)
+}
+
+// quarantine holds back the pending updates younger than
+// patching.min_package_age by adding them to the run's exclusions.
+func (a *App) quarantine(ctx context.Context, rep *report.Report, p patcher.Patcher, opt *patcher.Options) error {
+	held, err := patcher.Quarantine(ctx, p, *opt, a.quarantineOptions())
+	if err != nil {
+		return err
+	}
+	rep.HeldBack = held
+	if len(held) == 0 {
+		return nil
+	}
+	exclude := append([]string{}, opt.ExcludePackages...)
+	for _, h := range held {
+		exclude = append(exclude, h.Name)
+	}
+	opt.ExcludePackages = exclude
+	a.log.Info("holding back packages younger than min_package_age", "count", len(held), "min_package_age", a.cfg.MinPackageAge.String())
+	return nil
+}
+
+func (a *App) quarantineOptions() patcher.QuarantineOptions {
+	return patcher.QuarantineOptions{
+		MinAge:         a.cfg.MinPackageAge,
+		ExemptSeverity: a.cfg.Patching.AgeExemptSeverity,
+		FirstSeenFile:  a.cfg.Patching.FirstSeenFile,
+		Now:            time.Now(),
+	}
+}
+
+// cleanup removes old kernels, orphans and cached packages. Its failure
+// is reported but does not fail the run: the patches are already in.
+func (a *App) cleanup(ctx context.Context, rep *report.Report, p patcher.Patcher, opt patcher.Options) {
+	if _, ok := p.(patcher.Cleaner); !ok {
+		return
+	}
+	c := a.cfg.Patching.Cleanup
+	res := patcher.RunCleanup(ctx, p, opt, patcher.CleanupOptions{
+		KeepKernels: c.KeepKernels,
+		Autoremove:  c.Autoremove,
+		CleanCache:  c.CleanCache,
+	})
+	rep.Cleanup = &report.CleanupReport{BytesFreed: res.BytesFreed, Removed: res.Removed, Steps: res.Steps}
+	if res.Err != nil {
+		rep.Cleanup.Error = res.Err.Error()
+		a.log.Error("cleanup failed", "err", res.Err)
+		return
+	}
+	a.log.Info("cleanup done", "removed", len(res.Removed), "bytes_freed", res.BytesFreed)
+}
+
+const lockPollInterval = 5 * time.Second
+
+// waitForPackageLocks waits up to patching.lock_wait for other tools
+// (unattended-upgrades, PackageKit, cloud-init) to release the backend's
+// package manager locks. Stale lock files are reported but not waited for:
+// waiting does not make them go away.
+func (a *App) waitForPackageLocks(ctx context.Context, rep *report.Report, backend string) error {
+	start := time.Now()
+	for {
+		holders := patcher.LockHolders(backend)
+		var active []string
+		for _, h := range holders {
+			if !h.Stale {
+				active = append(active, h.String())
+			}
+		}
+		if rep.LockHolders == nil && len(holders) > 0 {
+			rep.LockHolders = holders
+		}
+		if len(active) == 0 {
+			return nil
+		}
+		if time.Since(start) >= a.cfg.LockWait {
+			return fmt.Errorf("package manager lock still held after %s: %s", a.cfg.LockWait, strings.Join(active, ", "))
+		}
+		if rep.LockWait == 0 {
+			a.log.Warn("package manager lock held by another process; waiting", "holders", strings.Join(active, ", "), "max_wait", a.cfg.LockWait.String())
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(lockPollInterval):
+		}
+		rep.LockWait = time.Since(start)
+	}
+}
+
+// takeSnapshot snapshots the configured target before patching. Dry runs
+// and snapshot.provider=none take no snapshot. A failed snapshot aborts the
+// run: patching without the safety net that was asked for is worse.
+func (a *App) takeSnapshot(ctx context.Context, rep *report.Report) (snapshot.Provider, *snapshot.Snapshot, error) {
+	if a.cfg.Snapshot.Provider == "none" || a.cfg.Patching.DryRun {
+		return nil, nil, nil
+	}
+	prov, err := snapshot.New(a.cfg.Snapshot.Provider, a.cfg.Snapshot.Target)
+	if err != nil {
+		return nil, nil, err
+	}
+	name := "serverpatcher-" + rep.Started.UTC().Format("20060102T150405Z")
+	st := patcher.Step{Name: "snapshot_create", Started: time.Now()}
+	snap, r, err := prov.Create(ctx, name)
+	st.Ended = time.Now()
+	st.Result = r
+	if err != nil {
+		st.Error = err.Error()
+		rep.Steps = append(rep.Steps, st)
+		return nil, nil, fmt.Errorf("pre-patch snapshot failed: %w", err)
+	}
+	rep.Steps = append(rep.Steps, st)
+	rep.Snapshot = snap
+	a.log.Info("pre-patch snapshot created", "provider", prov.Name(), "target", snap.Target, "name", snap.Name)
+	return prov, snap, nil
+}
+
+// settleSnapshot keeps, discards or rolls back to the pre-patch snapshot
+// depending on whether the backend and the post-hook succeeded.
+func (a *App) settleSnapshot(rep *report.Report, prov snapshot.Provider, snap *snapshot.Snapshot, ok bool) {
+	if snap == nil {
+		return
+	}
+	// The run context may be the thing that just expired.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+
+	run := func(name string, fn func(context.Context, *snapshot.Snapshot) (*executil.Result, error)) error {
+		st := patcher.Step{Name: name, Started: time.Now()}
+		r, err := fn(ctx, snap)
+		st.Ended = time.Now()
+		st.Result = r
+		if err != nil {
+			st.Error = err.Error()
+		}
+		rep.Steps = append(rep.Steps, st)
+		return err
+	}
+
+	switch {
+	case ok && a.cfg.Snapshot.KeepOnSuccess:
+		snap.Decision = snapshot.DecisionKept
+	case ok:
+		snap.Decision = snapshot.DecisionDiscarded
+		if err := run("snapshot_delete", prov.Delete); err != nil {
+			snap.Decision = snapshot.DecisionKept
+			snap.Error = err.Error()
+		}
+	case a.cfg.Snapshot.RollbackOnFailure:
+		snap.Decision = snapshot.DecisionRolledBack
+		if err := run("snapshot_rollback", prov.Rollback); err != nil {
+			snap.Decision = snapshot.DecisionRollbackFailed
+			snap.Error = err.Error()
+			break
+		}
+		// The host no longer has what the run installed.
+		rep.Reverted, rep.Changes = rep.Changes, nil
+		rep.AppliedPatches, rep.CVEs = nil, nil
+		if snap.RebootRequired {
+			rep.RebootRequired = true
+			rep.RebootReason = "rolled back to snapshot " + snap.Name + "; reboot to run the restored system"
+		}
+	default:
+		snap.Decision = snapshot.DecisionKept
+	}
+	a.log.Info("pre-patch snapshot settled", "name", snap.Name, "decision", snap.Decision)
+}
+
+// runSecondarySources patches the configured secondary sources (snap,
+// flatpak) after the distro backend and records each in rep.Sources.
+func (a *App) runSecondarySources(ctx context.Context, rep *report.Report) {
+	var sources []patcher.Patcher
+	for _, name := range a.cfg.Patching.SecondarySources {
+		src, err := patcher.NewSecondary(name)
+		if err != nil {
+			rep.Sources = append(rep.Sources, report.SourceReport{Source: name, Status: report.StatusFailed, Error: err.Error()})
+			continue
+		}
+		sources = append(sources, src)
+	}
+
+	for _, sr := range patcher.RunComposite(ctx, sources, a.patchOptions()) {
+		src := report.SourceReport{Source: sr.Source, Status: report.StatusSuccess, Changes: sr.Changes}
+		if sr.SnapshotErr != nil {
+			a.log.Warn("could not snapshot installed packages", "source", sr.Source, "err", sr.SnapshotErr)
+		}
+		if sr.Result != nil {
+			src.Patched = sr.Result.Patched
+			src.RebootRequired = sr.Result.RebootRequired
+			src.RebootReason = sr.Result.RebootReason
+			src.Plan = sr.Result.Plan
+			src.Steps = sr.Result.Steps
+		}
+		if sr.Err != nil {
+			src.Status = report.StatusFailed
+			src.Category = patcher.FailureCategory(src.Steps)
+			src.Error = sr.Err.Error()
+			a.log.Error("secondary source failed", "source", sr.Source, "err", sr.Err)
+		}
+		if src.RebootRequired {
+			rep.RebootRequired = true
+			if rep.RebootReason == "" {
+				rep.RebootReason = sr.Source + ": " + src.RebootReason
+			}
+		}
+		rep.Sources = append(rep.Sources, src)
+	}
+}
+
+// handleServices records services still running code that the upgrade
+// replaced and, with service_restart_policy=restart, restarts the allowed
+// ones. Restart failures are reported but do not fail the run.
+func (a *App) handleServices(ctx context.Context, rep *report.Report) {
+	affected, err := services.FindAffected()
+	if err != nil {
+		a.log.Warn("could not scan for services using replaced files", "err", err)
+		return
+	}
+	pc := a.cfg.Patching
+	for i := range affected {
+		s := &affected[i]
+		if pc.ServiceRestartPolicy != "restart" {
+			continue
+		}
+		if !services.Allowed(s.Unit, pc.ServiceRestartAllow, pc.ServiceRestartDeny) {
+			s.Action = services.ActionDenied
+			continue
+		}
+		st := patcher.Step{Name: "restart_" + s.Unit, Started: time.Now()}
+		r, err := services.Restart(ctx, s.Unit)
+		st.Ended = time.Now()
+		st.Result = r
+		if err != nil {
+			st.Error = err.Error()
+			s.Action = services.ActionFailed
+			s.Error = err.Error()
+			a.log.Warn("service restart failed", "unit", s.Unit, "err", err)
+		} else {
+			s.Action = services.ActionRestarted
+		}
+		rep.Steps = append(rep.Steps, st)
+	}
+	rep.Services = affected
+}
+
 func (a *App) runHook(ctx context.Context, stepName, hookPath string) (patcher.Step, error) {
 	st := patcher.Step{Name: stepName, Started: time.Now()}
 	r, err := executil.Run(ctx, hookPath)
@@ -221,7 +817,40 @@ func (a *App) runHook(ctx context.Context, stepName, hookPath string) (patcher.S
 	return st, nil
 }
 
+// preflight checks free space, memory and repository reachability and
+// records the results; the error names the checks that failed.
+func (a *App) preflight(ctx context.Context, rep *report.Report, backend string) error {
+	c := a.cfg.Preflight
+	const mb = 1 << 20
+	opt := preflight.Options{
+		Space: []preflight.Space{
+			{Path: "/", Min: c.MinFreeRootMB * mb},
+			{Path: "/var", Min: c.MinFreeVarMB * mb},
+			{Path: "/boot", Min: c.MinFreeBootMB * mb},
+			{Path: patcher.CacheDir(backend), Min: c.MinFreeCacheMB * mb},
+		},
+		MinMemory:   c.MinMemoryMB * mb,
+		RepoTimeout: a.cfg.RepoTimeout,
+	}
+	if c.CheckRepositories {
+		opt.Backend = backend
+	}
+	rep.Preflight = preflight.Run(ctx, opt)
+	failed := preflight.Failed(rep.Preflight)
+	if len(failed) == 0 {
+		return nil
+	}
+	msgs := make([]string, 0, len(failed))
+	for _, f := range failed {
+		msgs = append(msgs, fmt.Sprintf("%s (%s)", f.Name, f.Detail))
+	}
+	return fmt.Errorf("preflight check failed: %s", strings.Join(msgs, ", "))
+}
+
 func (a *App) finalize(rep *report.Report) error {
+	if rep.Error != "" && rep.FailureCategory == "" {
+		rep.FailureCategory = patcher.FailureCategory(rep.Steps)
+	}
 	path, err := report.WriteJSON(a.cfg.Report.Dir, rep)
 	if err != nil {
 		a.log.Error("failed to write report", "err", err)
@@ -268,10 +897,15 @@ func buildEmailBody(rep *report.Report) string {
 		"",
 		fmt.Sprintf("Host: %s", rep.Hostname),
 		fmt.Sprintf("Status: %s", rep.Status),
+	}
+	if rep.Reason != "" {
+		lines = append(lines, fmt.Sprintf("Reason: %s", rep.Reason))
+	}
+	lines = append(lines,
 		fmt.Sprintf("Backend: %s", rep.Backend),
 		fmt.Sprintf("Patched: %v", rep.Patched),
 		fmt.Sprintf("Reboot required: %v", rep.RebootRequired),
-	}
+	)
 	if rep.RebootReason != "" {
 		lines = append(lines, fmt.Sprintf("Reboot reason: %s", strings.TrimSpace(rep.RebootReason)))
 	}
@@ -279,6 +913,119 @@ func buildEmailBody(rep *report.Report) string {
 		fmt.Sprintf("Started: %s", rep.Started.Format(time.RFC3339)),
 		fmt.Sprintf("Ended:   %s", rep.Ended.Format(time.RFC3339)),
 		fmt.Sprintf("Duration: %s", rep.Duration.Round(time.Second).String()),
+	)
+	if len(rep.IncludePackages) > 0 {
+		lines = append(lines, "", fmt.Sprintf("Only packages matching: %s", strings.Join(rep.IncludePackages, ", ")))
+	}
+	if rep.SecurityFilter != "" {
+		lines = append(lines, "", fmt.Sprintf("Security filter: %s", rep.SecurityFilter))
+	}
+	if rep.PlanFile != "" {
+		lines = append(lines, "", fmt.Sprintf("Plan: %s", rep.PlanFile))
+	}
+	if len(rep.AppliedPatches) > 0 {
+		lines = append(lines, "", fmt.Sprintf("Applied patches: %s", strings.Join(rep.AppliedPatches, ", ")))
+	}
+	if len(rep.Changes) > 0 {
+		lines = append(lines, "", fmt.Sprintf("Package changes (%d):", len(rep.Changes)))
+		for _, c := range rep.Changes {
+			lines = append(lines, "- "+formatChange(c))
+		}
+	}
+	if len(rep.Reverted) > 0 {
+		lines = append(lines, "", fmt.Sprintf("Package changes undone by the snapshot rollback (%d):", len(rep.Reverted)))
+		for _, c := range rep.Reverted {
+			lines = append(lines, "- "+formatChange(c))
+		}
+	}
+	if len(rep.Plan) > 0 {
+		counts := map[patcher.ChangeAction]int{}
+		for _, c := range rep.Plan {
+			counts[c.Action]++
+		}
+		lines = append(lines, "", fmt.Sprintf("Dry-run plan: %d to upgrade, %d to install, %d to remove",
+			counts[patcher.ChangeUpgraded], counts[patcher.ChangeInstalled], counts[patcher.ChangeRemoved]))
+		for _, c := range rep.Plan {
+			lines = append(lines, "- "+formatChange(c))
+		}
+	}
+	if len(rep.HeldBack) > 0 {
+		lines = append(lines, "", fmt.Sprintf("Held back by min_package_age (%d):", len(rep.HeldBack)))
+		for _, h := range rep.HeldBack {
+			lines = append(lines, fmt.Sprintf("- %s %s: %s", h.Name, h.Candidate, h.Reason))
+		}
+	}
+	if failed := preflight.Failed(rep.Preflight); len(failed) > 0 {
+		lines = append(lines, "", "Failed preflight checks:")
+		for _, c := range failed {
+			lines = append(lines, fmt.Sprintf("- %s: %s", c.Name, c.Detail))
+		}
+	}
+	if len(rep.CVEs) > 0 {
+		lines = append(lines, "", fmt.Sprintf("Security advisories (%d CVEs):", len(rep.CVEs)))
+		changes := rep.Changes
+		if len(changes) == 0 {
+			changes = rep.Plan
+		}
+		for _, c := range changes {
+			if len(c.CVEs) == 0 && len(c.Advisories) == 0 {
+				continue
+			}
+			line := "- " + c.Name
+			if c.Severity != "" {
+				line += " [" + c.Severity + "]"
+			}
+			if len(c.Advisories) > 0 {
+				line += ": " + strings.Join(c.Advisories, ", ")
+			}
+			if len(c.CVEs) > 0 {
+				line += " (" + strings.Join(c.CVEs, ", ") + ")"
+			}
+			lines = append(lines, line)
+		}
+	}
+	if len(rep.LockHolders) > 0 {
+		held := make([]string, 0, len(rep.LockHolders))
+		for _, h := range rep.LockHolders {
+			held = append(held, h.String())
+		}
+		lines = append(lines, "", fmt.Sprintf("Package manager locks: %s (waited %s)", strings.Join(held, ", "), rep.LockWait.Round(time.Second)))
+	}
+	if rep.Snapshot != nil {
+		lines = append(lines, "", fmt.Sprintf("Snapshot: %s %s@%s (%s)", rep.Snapshot.Provider, rep.Snapshot.Target, rep.Snapshot.Name, rep.Snapshot.Decision))
+	}
+	if len(rep.Sources) > 0 {
+		lines = append(lines, "", "Secondary sources:")
+		for _, src := range rep.Sources {
+			line := fmt.Sprintf("- %s: %s (%d changes)", src.Source, src.Status, len(src.Changes))
+			if src.Category != "" {
+				line += " [" + string(src.Category) + "]"
+			}
+			if src.Error != "" {
+				line += ": " + src.Error
+			}
+			lines = append(lines, line)
+			for _, c := range src.Plan {
+				lines = append(lines, "  - would upgrade "+formatChange(c))
+			}
+		}
+	}
+	if rep.Cleanup != nil {
+		lines = append(lines, "", fmt.Sprintf("Cleanup: %d packages removed, %s freed", len(rep.Cleanup.Removed), preflight.FormatBytes(rep.Cleanup.BytesFreed)))
+		for _, c := range rep.Cleanup.Removed {
+			lines = append(lines, "- "+formatChange(c))
+		}
+		if rep.Cleanup.Error != "" {
+			lines = append(lines, "Cleanup error: "+rep.Cleanup.Error)
+		}
+	}
+	if len(rep.Services) > 0 {
+		lines = append(lines, "", fmt.Sprintf("Services using replaced files (%d):", len(rep.Services)))
+		for _, svc := range rep.Services {
+			lines = append(lines, fmt.Sprintf("- %s: %s", svc.Unit, svc.Action))
+		}
+	}
+	lines = append(lines,
 		"",
 		"Notes:",
 		"- The attached JSON contains full command output and step timing.",
@@ -286,10 +1033,28 @@ func buildEmailBody(rep *report.Report) string {
 	)
 	if rep.Error != "" {
 		lines = append(lines, "", "Error:", rep.Error)
+		if rep.FailureCategory != "" {
+			lines = append(lines, fmt.Sprintf("Failure category: %s", rep.FailureCategory))
+		}
 	}
 	return strings.Join(lines, "\n")
 }
 
+func formatChange(c patcher.PackageChange) string {
+	name := c.Name
+	if c.Arch != "" {
+		name += " (" + c.Arch + ")"
+	}
+	switch c.Action {
+	case patcher.ChangeInstalled:
+		return fmt.Sprintf("%s: installed %s", name, c.NewVersion)
+	case patcher.ChangeRemoved:
+		return fmt.Sprintf("%s: removed %s", name, c.OldVersion)
+	default:
+		return fmt.Sprintf("%s: %s -> %s", name, c.OldVersion, c.NewVersion)
+	}
+}
+
 func (a *App) requestReboot(ctx context.Context) error {
 	if _, ok := executil.LookPathAny("systemctl"); ok {
 		_, err := executil.Run(ctx, "systemctl", "reboot")
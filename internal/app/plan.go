@@ -0,0 +1,120 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/serverpatcher/serverpatcher/internal/osinfo"
+	"github.com/serverpatcher/serverpatcher/internal/patcher"
+	"github.com/serverpatcher/serverpatcher/internal/plan"
+	"github.com/serverpatcher/serverpatcher/internal/report"
+)
+
+// Plan lists the updates a run would install, honouring exclude_packages,
+// allow_kernel_updates, security_only and min_severity, as a sealed plan
+// for Apply.
+func (a *App) Plan(ctx context.Context) (*plan.Plan, error) {
+	info, err := osinfo.Detect()
+	if err != nil {
+		return nil, err
+	}
+	sel, err := patcher.Select(info, a.cfg.Patching.Backend)
+	if err != nil {
+		return nil, err
+	}
+	p := sel.Patcher
+	if _, ok := p.(patcher.VersionInstaller); !ok {
+		return nil, fmt.Errorf("backend %s cannot install exact package versions", p.Name())
+	}
+	opt := a.patchOptions()
+	pending, err := p.ListUpdates(ctx, opt)
+	if err != nil {
+		return nil, err
+	}
+	ups, err := patcher.FilterSeverity(ctx, p, patcher.FilterUpdates(p.Name(), pending, opt), opt)
+	if err != nil {
+		return nil, err
+	}
+	if a.cfg.MinPackageAge > 0 {
+		if ups, err = a.dropYoung(ctx, p, pending, ups, opt); err != nil {
+			return nil, err
+		}
+	}
+	pl := plan.New(plan.HostFingerprint(info), []plan.Backend{
+		{Backend: p.Name(), Packages: ups},
+	})
+	if err := pl.Seal([]byte(a.cfg.PlanKey)); err != nil {
+		return nil, err
+	}
+	return pl, nil
+}
+
+// Apply installs exactly the versions in a plan through the regular patch
+// pipeline. It refuses plans that fail verification, belong to another
+// host, are older than plan.max_age, or whose versions the repositories no
+// longer offer.
+func (a *App) Apply(ctx context.Context, planPath string) (*report.Report, error) {
+	var targets []patcher.PackageVersion
+	return a.run(ctx, job{
+		operation: "apply",
+		pinned:    true,
+		check: func(ctx context.Context, rep *report.Report, p patcher.Patcher) error {
+			rep.PlanFile = planPath
+			pl, err := plan.Read(planPath, []byte(a.cfg.PlanKey))
+			if err != nil {
+				return err
+			}
+			info, _ := osinfo.Detect()
+			if err := pl.Check(plan.HostFingerprint(info), a.cfg.PlanMaxAge, time.Now()); err != nil {
+				return err
+			}
+			if len(pl.Backends) != 1 || pl.Backends[0].Backend != p.Name() {
+				return fmt.Errorf("plan does not match the selected backend %s", p.Name())
+			}
+			if _, ok := p.(patcher.VersionInstaller); !ok {
+				return fmt.Errorf("backend %s cannot install exact package versions", p.Name())
+			}
+			planned := pl.Backends[0].Packages
+			current, err := p.ListUpdates(ctx, a.patchOptions())
+			if err != nil {
+				return err
+			}
+			if drift := plan.Drift(planned, current); len(drift) > 0 {
+				return fmt.Errorf("repositories changed since the plan was made:\n  %s", strings.Join(drift, "\n  "))
+			}
+			targets = plan.Targets(planned)
+			return nil
+		},
+		patch: func(ctx context.Context, p patcher.Patcher, opt patcher.Options) patcher.SourceResult {
+			return patcher.RunSourceFunc(ctx, p, func(ctx context.Context) (*patcher.PatchResult, error) {
+				if len(targets) == 0 {
+					return &patcher.PatchResult{Backend: p.Name()}, nil
+				}
+				return p.(patcher.VersionInstaller).InstallVersions(ctx, targets, opt)
+			})
+		},
+	})
+}
+
+// dropYoung leaves the updates patching.min_package_age holds back out of
+// a plan, so that applying it does not install them.
+func (a *App) dropYoung(ctx context.Context, p patcher.Patcher, pending, ups []patcher.PendingUpdate, opt patcher.Options) ([]patcher.PendingUpdate, error) {
+	held, err := patcher.HoldBackYoung(ctx, p, pending, ups, opt, a.quarantineOptions())
+	if err != nil {
+		return nil, err
+	}
+	young := map[string]bool{}
+	for _, h := range held {
+		young[h.Name+"."+h.Arch] = true
+		a.log.Info("holding back package younger than min_package_age", "package", h.Name, "candidate", h.Candidate, "reason", h.Reason)
+	}
+	var out []patcher.PendingUpdate
+	for _, u := range ups {
+		if !young[u.Name+"."+u.Arch] {
+			out = append(out, u)
+		}
+	}
+	return out, nil
+}
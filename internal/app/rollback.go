@@ -0,0 +1,113 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/serverpatcher/serverpatcher/internal/lock"
+	"github.com/serverpatcher/serverpatcher/internal/patcher"
+	"github.com/serverpatcher/serverpatcher/internal/report"
+)
+
+// Rollback restores the pre-patch versions recorded in a run report, using
+// the backend that made the changes. Packages the run newly installed are
+// left alone: removing them could take dependants with them.
+func (a *App) Rollback(ctx context.Context, reportPath string, dryRun bool) (*report.Report, error) {
+	orig, err := report.ReadJSON(reportPath)
+	if err != nil {
+		return nil, err
+	}
+	host, _ := os.Hostname()
+	if orig.Hostname != host {
+		return nil, fmt.Errorf("report %s is for host %q, this is %q", reportPath, orig.Hostname, host)
+	}
+	p, err := patcher.New(orig.Backend)
+	if err != nil {
+		return nil, err
+	}
+	vi, ok := p.(patcher.VersionInstaller)
+	if !ok {
+		return nil, fmt.Errorf("backend %s cannot install exact package versions", p.Name())
+	}
+
+	targets, skipped := rollbackTargets(orig.Changes)
+	rep := &report.Report{
+		App:       "Server Patcher",
+		Operation: "rollback",
+		Hostname:  host,
+		Started:   time.Now(),
+		Status:    report.StatusFailed,
+		Backend:   p.Name(),
+		OS:        orig.OS,
+		Rollback:  &report.RollbackInfo{Of: reportPath, Targets: targets, Skipped: skipped},
+	}
+
+	lk, err := lock.Acquire(a.cfg.Server.LockFile)
+	if err != nil {
+		rep.Status = report.StatusSkipped
+		rep.Error = err.Error()
+		rep.Ended = time.Now()
+		rep.Duration = rep.Ended.Sub(rep.Started)
+		_ = a.finalize(rep)
+		return rep, err
+	}
+	defer lk.Release()
+
+	if err := a.waitForPackageLocks(ctx, rep, p.Name()); err != nil {
+		rep.Status = report.StatusSkipped
+		rep.Error = err.Error()
+		rep.Ended = time.Now()
+		rep.Duration = rep.Ended.Sub(rep.Started)
+		_ = a.finalize(rep)
+		return rep, err
+	}
+
+	if len(targets) > 0 {
+		opt := a.patchOptions()
+		opt.DryRun = opt.DryRun || dryRun
+
+		before, snapErr := p.Installed(ctx)
+		res, rbErr := vi.InstallVersions(ctx, targets, opt)
+		if snapErr == nil {
+			if after, err := p.Installed(ctx); err == nil {
+				rep.Changes = patcher.DiffInstalled(before, after)
+			}
+		}
+		if res != nil {
+			rep.Patched = res.Patched
+			rep.Steps = append(rep.Steps, res.Steps...)
+		}
+		if rbErr != nil {
+			rep.Error = rbErr.Error()
+			rep.Ended = time.Now()
+			rep.Duration = rep.Ended.Sub(rep.Started)
+			_ = a.finalize(rep)
+			return rep, rbErr
+		}
+	}
+
+	rep.Status = report.StatusSuccess
+	rep.Ended = time.Now()
+	rep.Duration = rep.Ended.Sub(rep.Started)
+	if err := a.finalize(rep); err != nil {
+		return rep, err
+	}
+	return rep, nil
+}
+
+// rollbackTargets maps recorded changes to the versions to restore.
+// Multi-version entries (several kernels) are skipped because there is no
+// single version to go back to.
+func rollbackTargets(changes []patcher.PackageChange) (targets []patcher.PackageVersion, skipped []patcher.PackageChange) {
+	for _, c := range changes {
+		if c.Action == patcher.ChangeInstalled || c.OldVersion == "" || strings.Contains(c.OldVersion, ", ") {
+			skipped = append(skipped, c)
+			continue
+		}
+		targets = append(targets, patcher.PackageVersion{Name: c.Name, Arch: c.Arch, Version: c.OldVersion})
+	}
+	return targets, skipped
+}
@@ -4,16 +4,24 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"strings"
 	"time"
+
+	"github.com/serverpatcher/serverpatcher/internal/patcher"
+	"github.com/serverpatcher/serverpatcher/internal/schedule"
+	"github.com/serverpatcher/serverpatcher/internal/snapshot"
 )
 
 type Config struct {
-	Server   ServerConfig   `json:"server"`
-	Patching PatchingConfig `json:"patching"`
-	Email    EmailConfig    `json:"email"`
-	Logging  LoggingConfig  `json:"logging"`
-	Report   ReportConfig   `json:"report"`
-	Health   HealthConfig   `json:"health"`
+	Server    ServerConfig    `json:"server"`
+	Patching  PatchingConfig  `json:"patching"`
+	Email     EmailConfig     `json:"email"`
+	Logging   LoggingConfig   `json:"logging"`
+	Report    ReportConfig    `json:"report"`
+	Health    HealthConfig    `json:"health"`
+	Snapshot  SnapshotConfig  `json:"snapshot"`
+	Plan      PlanConfig      `json:"plan"`
+	Preflight PreflightConfig `json:"preflight"`
 }
 
 type ServerConfig struct {
@@ -21,19 +29,55 @@ type ServerConfig struct {
 	Jitter   string `json:"jitter"`   // duration string, e.g. "30m"
 	Timeout  string `json:"timeout"`  // duration string, e.g. "2h"
 	LockFile string `json:"lock_file"`
+	// DownloadAhead runs the download phase this long before each daemon
+	// run, which then only installs. "0s" disables it.
+	DownloadAhead string `json:"download_ahead"`
+	// Windows restricts daemon runs to maintenance windows such as
+	// "Tue,Thu 02:00-04:00 Europe/Zagreb"; empty runs at any time. A run
+	// with less than WindowReserve left in its window is deferred to the
+	// next one.
+	Windows       []string `json:"windows"`
+	WindowReserve string   `json:"window_reserve"` // duration string
 }
 
 type PatchingConfig struct {
-	DryRun          bool     `json:"dry_run"`
-	SecurityOnly    bool     `json:"security_only"`
-	ExcludePackages []string `json:"exclude_packages"`
-	PreHook         string   `json:"pre_hook"`
-	PostHook        string   `json:"post_hook"`
-	RebootPolicy    string   `json:"reboot_policy"` // none|notify|reboot
-	AllowKernel     bool     `json:"allow_kernel_updates"`
-	PackageTimeout  string   `json:"package_timeout"` // duration string
-	CommandNice     int      `json:"command_nice"`
-	CommandIonice   string   `json:"command_ionice"` // best-effort:7 | idle | realtime:1
+	Backend          string   `json:"backend"`           // auto|apt|dnf|yum|zypper|pacman|apk
+	SecondarySources []string `json:"secondary_sources"` // snap|flatpak|fwupd, run in order after the backend
+	DryRun           bool     `json:"dry_run"`
+	SecurityOnly     bool     `json:"security_only"`
+	MinSeverity      string   `json:"min_severity"` // security_only: low|moderate|important|critical, empty = all
+	ExcludePackages  []string `json:"exclude_packages"`
+	IncludePackages  []string `json:"include_packages"` // patterns; when set, only these are upgraded
+	PreHook          string   `json:"pre_hook"`
+	PostHook         string   `json:"post_hook"`
+	RebootPolicy     string   `json:"reboot_policy"` // none|notify|reboot
+	AllowKernel      bool     `json:"allow_kernel_updates"`
+	Advisories       bool     `json:"advisories"`      // look up advisories and CVEs for changed packages
+	PackageTimeout   string   `json:"package_timeout"` // duration string
+	LockWait         string   `json:"lock_wait"`       // duration string; wait for other tools' package locks
+	CommandNice      int      `json:"command_nice"`
+	CommandIonice    string   `json:"command_ionice"` // best-effort:7 | idle | realtime:1
+
+	ServiceRestartPolicy string   `json:"service_restart_policy"` // none|report|restart
+	ServiceRestartAllow  []string `json:"service_restart_allow"`  // unit patterns; empty = all
+	ServiceRestartDeny   []string `json:"service_restart_deny"`   // unit patterns; wins over allow
+
+	// MinPackageAge holds back candidate versions built (or, without build
+	// times, first seen) more recently. Security fixes of AgeExemptSeverity
+	// or higher are exempt.
+	MinPackageAge     string `json:"min_package_age"`             // duration string; "0s" disables it
+	AgeExemptSeverity string `json:"package_age_exempt_severity"` // low|moderate|important|critical, empty = none exempt
+	FirstSeenFile     string `json:"first_seen_file"`
+
+	Cleanup CleanupConfig `json:"cleanup"`
+}
+
+// CleanupConfig is what is removed after a successful patch run.
+type CleanupConfig struct {
+	Enabled     bool `json:"enabled"`
+	KeepKernels int  `json:"keep_kernels"` // newest kernels kept besides the running one; 0 keeps all
+	Autoremove  bool `json:"autoremove"`   // orphaned dependencies
+	CleanCache  bool `json:"clean_cache"`
 }
 
 type EmailConfig struct {
@@ -49,10 +93,10 @@ type EmailConfig struct {
 }
 
 type LoggingConfig struct {
-	Level    string `json:"level"` // debug|info|warn|error
-	File     string `json:"file"`
-	JSON     bool   `json:"json"`
-	AlsoStdout bool `json:"also_stdout"`
+	Level      string `json:"level"` // debug|info|warn|error
+	File       string `json:"file"`
+	JSON       bool   `json:"json"`
+	AlsoStdout bool   `json:"also_stdout"`
 }
 
 type ReportConfig struct {
@@ -65,13 +109,46 @@ type HealthConfig struct {
 	Listen  string `json:"listen"` // 127.0.0.1:9109
 }
 
+type SnapshotConfig struct {
+	Provider          string `json:"provider"` // none|lvm|snapper|zfs
+	Target            string `json:"target"`   // lvm: vg/lv, snapper: config name, zfs: dataset
+	KeepOnSuccess     bool   `json:"keep_on_success"`
+	RollbackOnFailure bool   `json:"rollback_on_failure"`
+}
+
+type PlanConfig struct {
+	MaxAge string `json:"max_age"` // duration string; "0" disables the age check
+	KeyEnv string `json:"key_env"` // env var name holding the HMAC key; unset = checksum only
+}
+
+// PreflightConfig sets the checks a run must pass before it changes
+// anything. A threshold of 0 disables that check.
+type PreflightConfig struct {
+	Enabled           bool   `json:"enabled"`
+	MinFreeRootMB     uint64 `json:"min_free_root_mb"`
+	MinFreeVarMB      uint64 `json:"min_free_var_mb"`
+	MinFreeBootMB     uint64 `json:"min_free_boot_mb"`
+	MinFreeCacheMB    uint64 `json:"min_free_cache_mb"` // the backend's package cache
+	MinMemoryMB       uint64 `json:"min_memory_mb"`
+	CheckRepositories bool   `json:"check_repositories"`
+	RepoTimeout       string `json:"repo_timeout"` // duration string
+}
+
 type Parsed struct {
 	Config
 	ServerInterval time.Duration
 	ServerJitter   time.Duration
 	ServerTimeout  time.Duration
+	DownloadAhead  time.Duration
 	PackageTimeout time.Duration
+	LockWait       time.Duration
 	EmailPassword  string
+	PlanMaxAge     time.Duration
+	PlanKey        string
+	RepoTimeout    time.Duration
+	MinPackageAge  time.Duration
+	Windows        schedule.Windows
+	WindowReserve  time.Duration
 }
 
 func Default() Config {
@@ -81,18 +158,51 @@ func Default() Config {
 			Jitter:   "30m",
 			Timeout:  "2h",
 			LockFile: "/var/lock/serverpatcher.lock",
+
+			DownloadAhead: "0s",
+			Windows:       []string{},
+			WindowReserve: "15m",
 		},
 		Patching: PatchingConfig{
-			DryRun:          false,
-			SecurityOnly:    false,
-			ExcludePackages: []string{},
-			PreHook:         "",
-			PostHook:        "",
-			RebootPolicy:    "notify",
-			AllowKernel:     true,
-			PackageTimeout:  "90m",
-			CommandNice:     10,
-			CommandIonice:   "best-effort:7",
+			Backend:          "auto",
+			SecondarySources: []string{},
+			DryRun:           false,
+			SecurityOnly:     false,
+			MinSeverity:      "",
+			ExcludePackages:  []string{},
+			IncludePackages:  []string{},
+			PreHook:          "",
+			PostHook:         "",
+			RebootPolicy:     "notify",
+			AllowKernel:      true,
+			Advisories:       true,
+			PackageTimeout:   "90m",
+			LockWait:         "10m",
+			CommandNice:      10,
+			CommandIonice:    "best-effort:7",
+
+			ServiceRestartPolicy: "report",
+			ServiceRestartAllow:  []string{},
+			ServiceRestartDeny: []string{
+				"dbus*.service",
+				"systemd-*.service",
+				"getty@*.service",
+				"serial-getty@*.service",
+				"user@*.service",
+				"display-manager.service",
+				"serverpatcher.service",
+			},
+
+			MinPackageAge:     "0s",
+			AgeExemptSeverity: "important",
+			FirstSeenFile:     "/var/lib/serverpatcher/first_seen.json",
+
+			Cleanup: CleanupConfig{
+				Enabled:     false,
+				KeepKernels: 2,
+				Autoremove:  true,
+				CleanCache:  true,
+			},
 		},
 		Email: EmailConfig{
 			Enabled:       false,
@@ -119,6 +229,26 @@ func Default() Config {
 			Enabled: false,
 			Listen:  "127.0.0.1:9109",
 		},
+		Snapshot: SnapshotConfig{
+			Provider:          "none",
+			Target:            "",
+			KeepOnSuccess:     false,
+			RollbackOnFailure: true,
+		},
+		Plan: PlanConfig{
+			MaxAge: "24h",
+			KeyEnv: "SERVERPATCHER_PLAN_KEY",
+		},
+		Preflight: PreflightConfig{
+			Enabled:           false,
+			MinFreeRootMB:     512,
+			MinFreeVarMB:      1024,
+			MinFreeBootMB:     128,
+			MinFreeCacheMB:    512,
+			MinMemoryMB:       128,
+			CheckRepositories: true,
+			RepoTimeout:       "10s",
+		},
 	}
 }
 
@@ -151,9 +281,33 @@ func Parse(cfg Config) (*Parsed, error) {
 	if p.ServerTimeout, err = time.ParseDuration(cfg.Server.Timeout); err != nil {
 		return nil, fmt.Errorf("server.timeout invalid: %w", err)
 	}
+	if p.Windows, err = schedule.ParseAll(cfg.Server.Windows); err != nil {
+		return nil, fmt.Errorf("server.windows invalid: %w", err)
+	}
+	if p.WindowReserve, err = time.ParseDuration(cfg.Server.WindowReserve); err != nil {
+		return nil, fmt.Errorf("server.window_reserve invalid: %w", err)
+	}
+	if p.LockWait, err = time.ParseDuration(cfg.Patching.LockWait); err != nil {
+		return nil, fmt.Errorf("patching.lock_wait invalid: %w", err)
+	}
+	if p.DownloadAhead, err = time.ParseDuration(cfg.Server.DownloadAhead); err != nil {
+		return nil, fmt.Errorf("server.download_ahead invalid: %w", err)
+	}
 	if p.PackageTimeout, err = time.ParseDuration(cfg.Patching.PackageTimeout); err != nil {
 		return nil, fmt.Errorf("patching.package_timeout invalid: %w", err)
 	}
+	if p.MinPackageAge, err = time.ParseDuration(cfg.Patching.MinPackageAge); err != nil {
+		return nil, fmt.Errorf("patching.min_package_age invalid: %w", err)
+	}
+	if p.PlanMaxAge, err = time.ParseDuration(cfg.Plan.MaxAge); err != nil {
+		return nil, fmt.Errorf("plan.max_age invalid: %w", err)
+	}
+	if p.RepoTimeout, err = time.ParseDuration(cfg.Preflight.RepoTimeout); err != nil {
+		return nil, fmt.Errorf("preflight.repo_timeout invalid: %w", err)
+	}
+	if cfg.Plan.KeyEnv != "" {
+		p.PlanKey = os.Getenv(cfg.Plan.KeyEnv)
+	}
 
 	if cfg.Email.Enabled {
 		if cfg.Email.From == "" || len(cfg.Email.To) == 0 || cfg.Email.SMTPHost == "" {
@@ -173,6 +327,61 @@ func Parse(cfg Config) (*Parsed, error) {
 		return nil, fmt.Errorf("invalid patching.reboot_policy: %q (expected none|notify|reboot)", cfg.Patching.RebootPolicy)
 	}
 
+	switch cfg.Patching.Backend {
+	case "auto", "apt", "dnf", "yum", "zypper", "pacman", "apk":
+	default:
+		return nil, fmt.Errorf("invalid patching.backend: %q (expected auto|apt|dnf|yum|zypper|pacman|apk)", cfg.Patching.Backend)
+	}
+
+	if err := patcher.CheckInclude(cfg.Patching.Backend, cfg.Patching.IncludePackages); err != nil {
+		return nil, fmt.Errorf("patching.%w", err)
+	}
+
+	known := map[string]bool{}
+	for _, src := range patcher.SecondarySources {
+		known[src] = true
+	}
+	for _, src := range cfg.Patching.SecondarySources {
+		if !known[src] {
+			return nil, fmt.Errorf("invalid patching.secondary_sources entry: %q (expected %s)", src, strings.Join(patcher.SecondarySources, "|"))
+		}
+	}
+
+	if cfg.Snapshot.Provider != "none" {
+		if _, err := snapshot.New(cfg.Snapshot.Provider, cfg.Snapshot.Target); err != nil {
+			return nil, fmt.Errorf("invalid snapshot config: %w", err)
+		}
+	}
+
+	switch cfg.Patching.ServiceRestartPolicy {
+	case "none", "report", "restart":
+	default:
+		return nil, fmt.Errorf("invalid patching.service_restart_policy: %q (expected none|report|restart)", cfg.Patching.ServiceRestartPolicy)
+	}
+
+	switch cfg.Patching.MinSeverity {
+	case "":
+	case "low", "moderate", "important", "critical":
+		if !cfg.Patching.SecurityOnly {
+			return nil, fmt.Errorf("patching.min_severity requires patching.security_only=true")
+		}
+	default:
+		return nil, fmt.Errorf("invalid patching.min_severity: %q (expected low|moderate|important|critical)", cfg.Patching.MinSeverity)
+	}
+
+	switch cfg.Patching.AgeExemptSeverity {
+	case "", "low", "moderate", "important", "critical":
+	default:
+		return nil, fmt.Errorf("invalid patching.package_age_exempt_severity: %q (expected low|moderate|important|critical)", cfg.Patching.AgeExemptSeverity)
+	}
+	if p.MinPackageAge > 0 && cfg.Patching.FirstSeenFile == "" {
+		return nil, fmt.Errorf("patching.min_package_age requires patching.first_seen_file")
+	}
+
+	if cfg.Patching.Cleanup.KeepKernels < 0 {
+		return nil, fmt.Errorf("invalid patching.cleanup.keep_kernels: %d", cfg.Patching.Cleanup.KeepKernels)
+	}
+
 	return p, nil
 }
 
@@ -189,4 +398,4 @@ func DefaultJSON(pretty bool) (string, error) {
 		return "", err
 	}
 	return string(b) + "\n", nil
-}
\ No newline at end of file
+}
@@ -17,6 +17,8 @@ type Server struct {
 
 	mu   sync.RWMutex
 	last *report.Report
+	// The current or next maintenance window, if server.windows is set.
+	windowStart, windowEnd time.Time
 }
 
 func New(addr string, log *slog.Logger) *Server {
@@ -29,12 +31,19 @@ func (s *Server) SetLast(r *report.Report) {
 	s.last = r
 }
 
+func (s *Server) SetNextWindow(start, end time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.windowStart, s.windowEnd = start, end
+}
+
 func (s *Server) Run(ctx context.Context) error {
 	mux := http.NewServeMux()
 
 	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
 		s.mu.RLock()
 		last := s.last
+		windowStart, windowEnd := s.windowStart, s.windowEnd
 		s.mu.RUnlock()
 
 		w.Header().Set("Content-Type", "application/json")
@@ -46,6 +55,9 @@ func (s *Server) Run(ctx context.Context) error {
 			resp["last_backend"] = last.Backend
 			resp["last_reboot_required"] = last.RebootRequired
 		}
+		if !windowStart.IsZero() {
+			resp["next_window"] = map[string]any{"start": windowStart, "end": windowEnd}
+		}
 		_ = json.NewEncoder(w).Encode(resp)
 	})
 
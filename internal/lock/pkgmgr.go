@@ -0,0 +1,154 @@
+package lock
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+var procDir = "/proc"
+
+// Kind is how a package manager marks its lock.
+type Kind int
+
+const (
+	// Held is a file locked with fcntl or flock (dpkg, rpm, apk).
+	Held Kind = iota
+	// PIDFile is a file holding the owner's PID (yum, dnf, zypper).
+	PIDFile
+	// Exists is a file whose mere presence is the lock (pacman).
+	Exists
+)
+
+type File struct {
+	Path string
+	Kind Kind
+}
+
+// Holder is a process holding a package manager lock. PID is 0 when the
+// holder could not be identified. Stale marks a lock file left behind by
+// a process that is gone.
+type Holder struct {
+	Path  string `json:"path"`
+	PID   int    `json:"pid,omitempty"`
+	Comm  string `json:"comm,omitempty"`
+	Stale bool   `json:"stale,omitempty"`
+}
+
+func (h Holder) String() string {
+	switch {
+	case h.Stale:
+		return h.Path + " (stale)"
+	case h.PID == 0:
+		return h.Path + " (holder unknown)"
+	}
+	return fmt.Sprintf("%s (pid %d, %s)", h.Path, h.PID, h.Comm)
+}
+
+// Holders reports which of files are currently locked by processes other
+// than this one. Files that do not exist are not locked.
+func Holders(files []File) []Holder {
+	var held []Holder
+	self := os.Getpid()
+	for _, f := range files {
+		var st syscall.Stat_t
+		if err := syscall.Stat(f.Path, &st); err != nil {
+			continue
+		}
+		h := Holder{Path: f.Path}
+		switch f.Kind {
+		case Held:
+			pid, ok := posixLockHolder(st)
+			if !ok {
+				continue
+			}
+			// OFD locks carry no PID; find who has the file open.
+			if pid <= 0 {
+				pid = openedBy(f.Path)
+			}
+			h.PID = pid
+		case PIDFile:
+			b, err := os.ReadFile(f.Path)
+			if err != nil {
+				continue
+			}
+			pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+			if err != nil || pid <= 0 {
+				continue
+			}
+			if _, err := os.Stat(filepath.Join(procDir, strconv.Itoa(pid))); err != nil {
+				// dnf and zypper clean up pid files of dead processes themselves.
+				continue
+			}
+			h.PID = pid
+		case Exists:
+			h.PID = openedBy(f.Path)
+			h.Stale = h.PID == 0
+		}
+		if h.PID == self {
+			continue
+		}
+		if h.PID > 0 {
+			comm, _ := os.ReadFile(filepath.Join(procDir, strconv.Itoa(h.PID), "comm"))
+			h.Comm = strings.TrimSpace(string(comm))
+		}
+		held = append(held, h)
+	}
+	return held
+}
+
+// posixLockHolder looks the file up in /proc/locks, which lists fcntl and
+// flock locks alike as "id: TYPE MODE ACCESS pid maj:min:inode start end".
+func posixLockHolder(st syscall.Stat_t) (int, bool) {
+	f, err := os.Open(filepath.Join(procDir, "locks"))
+	if err != nil {
+		return 0, false
+	}
+	defer f.Close()
+
+	dev := uint64(st.Dev)
+	major := (dev>>8)&0xfff | (dev>>32)&^uint64(0xfff)
+	minor := dev&0xff | (dev>>12)&^uint64(0xff)
+	want := fmt.Sprintf("%02x:%02x:%d", major, minor, st.Ino)
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		// Waiters are listed as "id: -> TYPE ..." under the holder.
+		if len(fields) < 6 || fields[1] == "->" || fields[5] != want {
+			continue
+		}
+		pid, _ := strconv.Atoi(fields[4])
+		return pid, true
+	}
+	return 0, false
+}
+
+// openedBy returns the PID of a process with path open, or 0.
+func openedBy(path string) int {
+	entries, err := os.ReadDir(procDir)
+	if err != nil {
+		return 0
+	}
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		fdDir := filepath.Join(procDir, e.Name(), "fd")
+		fds, err := os.ReadDir(fdDir)
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			if target, err := os.Readlink(filepath.Join(fdDir, fd.Name())); err == nil && target == path {
+				return pid
+			}
+		}
+	}
+	return 0
+}
@@ -15,6 +15,7 @@ type Info struct {
 	VersionID  string `json:"version_id"`
 	PrettyName string `json:"pretty_name"`
 	Like       string `json:"like"`
+	Codename   string `json:"version_codename,omitempty"`
 }
 
 // unquote removes surrounding quotes from values in /etc/os-release
@@ -66,6 +67,7 @@ func Detect() (*Info, error) {
 		VersionID:  m["VERSION_ID"],
 		PrettyName: m["PRETTY_NAME"],
 		Like:       strings.ToLower(m["ID_LIKE"]),
+		Codename:   m["VERSION_CODENAME"],
 	}
 
 	// Fallback: if NAME is empty, try PRETTY_NAME
@@ -99,11 +101,15 @@ func (i *Info) IsLike(token string) bool {
 }
 
 // Convenience methods
-func (i *Info) IsDebianLike() bool   { return i.IsLike("debian") }
-func (i *Info) IsUbuntu() bool      { return i.ID == "ubuntu" }
-func (i *Info) IsRHELLike() bool    { return i.IsLike("rhel") || i.IsLike("fedora") }
-func (i *Info) IsArchLinux() bool   { return i.ID == "arch" || i.IsLike("arch") }
-func (i *Info) IsAlmaLinux() bool   { return i.ID == "almalinux" }
-func (i *Info) IsRockyLinux() bool  { return i.ID == "rocky" }
-func (i *Info) IsCentOS() bool      { return i.ID == "centos" }
-func (i *Info) IsFedora() bool      { return i.ID == "fedora" }
\ No newline at end of file
+func (i *Info) IsDebianLike() bool { return i.IsLike("debian") }
+func (i *Info) IsUbuntu() bool     { return i.ID == "ubuntu" }
+func (i *Info) IsRHELLike() bool   { return i.IsLike("rhel") || i.IsLike("fedora") }
+func (i *Info) IsArchLinux() bool  { return i.ID == "arch" || i.IsLike("arch") }
+func (i *Info) IsAlmaLinux() bool  { return i.ID == "almalinux" }
+func (i *Info) IsRockyLinux() bool { return i.ID == "rocky" }
+func (i *Info) IsCentOS() bool     { return i.ID == "centos" }
+func (i *Info) IsFedora() bool     { return i.ID == "fedora" }
+func (i *Info) IsSUSELike() bool {
+	return i.IsLike("suse") || strings.HasPrefix(i.ID, "opensuse") || i.ID == "sles"
+}
+func (i *Info) IsAlpine() bool { return i.ID == "alpine" }
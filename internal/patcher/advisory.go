@@ -0,0 +1,166 @@
+package patcher
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/serverpatcher/serverpatcher/internal/pkgver"
+)
+
+// Advisory is a security advisory fixed in Version of Package. ID is the
+// vendor's advisory (RHSA-2024:1234, SUSE-SLE-...-2024-1234, DSA-5678-1)
+// and may be empty when only CVEs are known, as with Debian changelogs.
+type Advisory struct {
+	ID       string
+	Severity string // low|moderate|important|critical, or empty
+	CVEs     []string
+	Package  string
+	Arch     string // empty matches any arch
+	Version  string
+}
+
+// AdvisoryLister is implemented by backends that can tell which security
+// advisories a set of package changes fixes.
+type AdvisoryLister interface {
+	Advisories(ctx context.Context, changes []PackageChange, opt Options) ([]Advisory, error)
+}
+
+var severityRank = map[string]int{"low": 1, "moderate": 2, "important": 3, "critical": 4}
+
+// severitiesFrom lists min and the severities above it, lowest first.
+func severitiesFrom(min string) []string {
+	var out []string
+	for _, s := range []string{"low", "moderate", "important", "critical"} {
+		if severityRank[s] >= severityRank[min] {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// NormalizeSeverity maps vendor severities, including arch-audit's Medium
+// and High, onto low|moderate|important|critical; anything else becomes "".
+func NormalizeSeverity(s string) string {
+	s = strings.ToLower(strings.TrimSpace(s))
+	switch s {
+	case "medium":
+		return "moderate"
+	case "high":
+		return "important"
+	}
+	if _, ok := severityRank[s]; ok {
+		return s
+	}
+	return ""
+}
+
+// SeverityAtLeast reports whether severity s is min or higher. Unknown
+// severities never qualify.
+func SeverityAtLeast(s, min string) bool {
+	r, ok := severityRank[s]
+	return ok && r >= severityRank[min]
+}
+
+// AttachAdvisories sets advisory IDs, CVEs and the highest severity on the
+// upgraded and installed packages in changes, using the advisories whose
+// fixed version lies between the old (exclusive) and new version.
+func AttachAdvisories(changes []PackageChange, advs []Advisory) {
+	for i := range changes {
+		c := &changes[i]
+		if c.Action == ChangeRemoved {
+			continue
+		}
+		for _, a := range advs {
+			if a.Package != c.Name || (a.Arch != "" && c.Arch != "" && a.Arch != c.Arch) {
+				continue
+			}
+			if a.Version != "" {
+				if compareNoEpoch(a.Version, c.NewVersion) > 0 {
+					continue
+				}
+				if c.OldVersion != "" && compareNoEpoch(a.Version, c.OldVersion) <= 0 {
+					continue
+				}
+			}
+			if a.ID != "" {
+				c.Advisories = appendUnique(c.Advisories, a.ID)
+			}
+			for _, cve := range a.CVEs {
+				c.CVEs = appendUnique(c.CVEs, cve)
+			}
+			if severityRank[a.Severity] > severityRank[c.Severity] {
+				c.Severity = a.Severity
+			}
+		}
+		sort.Strings(c.CVEs)
+	}
+}
+
+// FilterSeverity keeps the updates that fix an advisory of at least
+// opt.MinSeverity according to p's advisory data. Without SecurityOnly or
+// MinSeverity it returns ups unchanged.
+func FilterSeverity(ctx context.Context, p Patcher, ups []PendingUpdate, opt Options) ([]PendingUpdate, error) {
+	if !opt.SecurityOnly || opt.MinSeverity == "" || len(ups) == 0 {
+		return ups, nil
+	}
+	if _, ok := p.(AdvisoryLister); !ok {
+		return nil, fmt.Errorf("backend %s has no advisory data to apply min_severity", p.Name())
+	}
+	sev, err := updateSeverities(ctx, p, ups, opt)
+	if err != nil {
+		return nil, err
+	}
+	var out []PendingUpdate
+	for i, u := range ups {
+		if SeverityAtLeast(sev[i], opt.MinSeverity) {
+			out = append(out, u)
+		}
+	}
+	return out, nil
+}
+
+// updateSeverities returns the highest advisory severity each update
+// fixes, "" where none is known or p has no advisory data.
+func updateSeverities(ctx context.Context, p Patcher, ups []PendingUpdate, opt Options) ([]string, error) {
+	sev := make([]string, len(ups))
+	al, ok := p.(AdvisoryLister)
+	if !ok {
+		return sev, nil
+	}
+	changes := make([]PackageChange, 0, len(ups))
+	for _, u := range ups {
+		changes = append(changes, PackageChange{Name: u.Name, Arch: u.Arch, OldVersion: u.Current, NewVersion: u.Candidate, Action: ChangeUpgraded})
+	}
+	advs, err := al.Advisories(ctx, changes, opt)
+	if err != nil {
+		return nil, err
+	}
+	AttachAdvisories(changes, advs)
+	for i, c := range changes {
+		sev[i] = c.Severity
+	}
+	return sev, nil
+}
+
+// compareNoEpoch compares versions ignoring an "N:" epoch, which only one
+// side may carry.
+func compareNoEpoch(a, b string) int {
+	strip := func(v string) string {
+		if e, rest, ok := strings.Cut(v, ":"); ok && e != "" && strings.Trim(e, "0123456789") == "" {
+			return rest
+		}
+		return v
+	}
+	return pkgver.Compare(strip(a), strip(b))
+}
+
+func appendUnique(list []string, v string) []string {
+	for _, s := range list {
+		if s == v {
+			return list
+		}
+	}
+	return append(list, v)
+}
@@ -0,0 +1,176 @@
+package patcher
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Publisher is implemented by backends whose repository metadata carries
+// the build time of candidate versions. PublishTimes returns one time per
+// update; zero means unknown.
+type Publisher interface {
+	PublishTimes(ctx context.Context, ups []PendingUpdate, opt Options) ([]time.Time, error)
+}
+
+// HeldBack is a pending update kept back because its candidate is newer
+// than the minimum package age.
+type HeldBack struct {
+	Name      string    `json:"name"`
+	Arch      string    `json:"arch,omitempty"`
+	Candidate string    `json:"candidate_version"`
+	Published time.Time `json:"published"`
+	// Source is "repository" for metadata build times and "first_seen"
+	// when the time is when serverpatcher first saw the candidate.
+	Source string `json:"source"`
+	Reason string `json:"reason"`
+}
+
+type QuarantineOptions struct {
+	MinAge time.Duration
+	// ExemptSeverity lets updates fixing a security advisory of this
+	// severity or higher through regardless of age; empty exempts none.
+	ExemptSeverity string
+	// FirstSeenFile records when candidates without a build time were
+	// first seen.
+	FirstSeenFile string
+	Now           time.Time
+}
+
+// Quarantine returns the pending updates of p whose candidate version is
+// younger than q.MinAge. Build times come from repository metadata where
+// the backend has them; otherwise, or when looking them up fails, a
+// candidate's age counts from the first run that saw it.
+func Quarantine(ctx context.Context, p Patcher, opt Options, q QuarantineOptions) ([]HeldBack, error) {
+	ups, err := p.ListUpdates(ctx, opt)
+	if err != nil {
+		return nil, err
+	}
+	return HoldBackYoung(ctx, p, ups, FilterUpdates(p.Name(), ups, opt), opt, q)
+}
+
+// HoldBackYoung is Quarantine for already listed updates: ups are the ones
+// the run would install, pending all of the backend's pending updates,
+// which keep their first-seen entries.
+func HoldBackYoung(ctx context.Context, p Patcher, pending, ups []PendingUpdate, opt Options, q QuarantineOptions) ([]HeldBack, error) {
+	if len(ups) == 0 {
+		return nil, nil
+	}
+	times := make([]time.Time, len(ups))
+	if pub, ok := p.(Publisher); ok {
+		if t, err := pub.PublishTimes(ctx, ups, opt); err == nil && len(t) == len(ups) {
+			times = t
+		}
+	}
+	sources := make([]string, len(ups))
+	for i := range times {
+		sources[i] = "repository"
+	}
+	if err := firstSeen(q.FirstSeenFile, p.Name(), pending, ups, times, sources, q.Now, !opt.DryRun); err != nil {
+		return nil, err
+	}
+
+	var young []PendingUpdate
+	var held []HeldBack
+	for i, u := range ups {
+		age := q.Now.Sub(times[i])
+		if age >= q.MinAge {
+			continue
+		}
+		young = append(young, u)
+		held = append(held, HeldBack{
+			Name:      u.Name,
+			Arch:      u.Arch,
+			Candidate: u.Candidate,
+			Published: times[i],
+			Source:    sources[i],
+			Reason:    fmt.Sprintf("%s old, younger than %s", age.Round(time.Minute), q.MinAge),
+		})
+	}
+
+	if q.ExemptSeverity == "" || len(young) == 0 {
+		return held, nil
+	}
+	sev, err := updateSeverities(ctx, p, young, opt)
+	if err != nil {
+		// Without advisory data nothing is exempt; holding back is the
+		// safe side.
+		return held, nil
+	}
+	var out []HeldBack
+	for i, h := range held {
+		if SeverityAtLeast(sev[i], q.ExemptSeverity) {
+			continue
+		}
+		out = append(out, h)
+	}
+	return out, nil
+}
+
+// firstSeen fills in unknown times from the first-seen file, recording
+// now for candidates it has not seen before. Entries of candidates no
+// longer in pending are dropped. Without write the file is left as is.
+func firstSeen(path, backend string, pending, ups []PendingUpdate, times []time.Time, sources []string, now time.Time, write bool) error {
+	seen := map[string]time.Time{}
+	if b, err := os.ReadFile(path); err == nil {
+		if err := json.Unmarshal(b, &seen); err != nil {
+			return fmt.Errorf("parse %s: %w", path, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	key := func(u PendingUpdate) string { return backend + " " + u.Name + "." + u.Arch + " " + u.Candidate }
+	next := map[string]time.Time{}
+	for k, t := range seen {
+		if !strings.HasPrefix(k, backend+" ") {
+			next[k] = t
+		}
+	}
+	for _, u := range pending {
+		if t, ok := seen[key(u)]; ok {
+			next[key(u)] = t
+		}
+	}
+	for i, u := range ups {
+		if !times[i].IsZero() {
+			continue
+		}
+		k := key(u)
+		t, ok := seen[k]
+		if !ok {
+			t = now
+		}
+		next[k] = t
+		times[i] = t
+		sources[i] = "first_seen"
+	}
+	if !write {
+		return nil
+	}
+	b, err := json.MarshalIndent(next, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, b, 0644)
+}
+
+// parseBuildTime reads a repoquery build time: Unix seconds (yum, dnf5)
+// or "2006-01-02 15:04" in UTC (dnf4).
+func parseBuildTime(s string) (time.Time, bool) {
+	s = strings.TrimSpace(s)
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil && n > 0 {
+		return time.Unix(n, 0), true
+	}
+	if t, err := time.Parse("2006-01-02 15:04", s); err == nil {
+		return t, true
+	}
+	return time.Time{}, false
+}
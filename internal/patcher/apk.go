@@ -1,8 +1,18 @@
 package patcher
 
 import (
+	"archive/tar"
+	"compress/gzip"
 	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/serverpatcher/serverpatcher/internal/executil"
 	"github.com/serverpatcher/serverpatcher/internal/osinfo"
 )
 
@@ -16,10 +26,23 @@ func (p *Apk) Patch(ctx context.Context, opt Options) (*PatchResult, error) {
 	localCtx, cancel := context.WithTimeout(ctx, opt.Timeout)
 	defer cancel()
 
+	if opt.SecurityOnly {
+		return res, fmt.Errorf("security_only is not supported on apk: Alpine repositories carry no security advisory metadata")
+	}
+
 	steps := []Step{}
 	cmd, base := prefixWithQoS("apk", nil, opt.Nice, opt.Ionice)
 
-	{
+	exclude := append([]string{}, opt.ExcludePackages...)
+	if !opt.AllowKernel {
+		exclude = append(exclude, apkKernelPatterns...)
+	}
+
+	if opt.Phase == PhaseDownload && !fileExists(apkCacheDir) {
+		return res, fmt.Errorf("the download phase on apk needs the package cache (%s); enable it with setup-apkcache", apkCacheDir)
+	}
+
+	if opt.Phase != PhaseInstall {
 		args := append(append([]string{}, base...), "update")
 		st, err := runStep(localCtx, "apk_update", cmd, args)
 		steps = append(steps, st)
@@ -29,12 +52,62 @@ func (p *Apk) Patch(ctx context.Context, opt Options) (*PatchResult, error) {
 		}
 	}
 
+	// apk has no exclude flag, so with excludes or include_packages in
+	// effect upgrade the selected upgradable packages by name instead of
+	// everything. Fetching always works by name.
+	named := len(exclude) > 0 || len(opt.IncludePackages) > 0 || opt.Phase == PhaseDownload
+	var selected []string
+	if named {
+		args := append(append([]string{}, base...), "version", "-l", "<")
+		st, err := runStep(localCtx, "apk_version", cmd, args)
+		steps = append(steps, st)
+		if err != nil {
+			res.Steps = steps
+			return res, err
+		}
+		for _, u := range parseApkVersion(st.Result.Stdout) {
+			if matchAny(u.Name, exclude) {
+				continue
+			}
+			if len(opt.IncludePackages) > 0 && !matchAny(u.Name, opt.IncludePackages) {
+				continue
+			}
+			selected = append(selected, u.Name)
+		}
+		if len(selected) == 0 {
+			applyRebootCheck(res)
+			res.Steps = steps
+			return res, nil
+		}
+	}
+
+	if opt.Phase == PhaseDownload && !opt.DryRun {
+		args := []string{"fetch", "--recursive", "--output", apkCacheDir}
+		args = append(append(append([]string{}, base...), args...), selected...)
+		st, err := runStep(localCtx, "apk_fetch", cmd, args)
+		steps = append(steps, st)
+		if err != nil {
+			res.Steps = steps
+			return res, err
+		}
+		applyRebootCheck(res)
+		res.Steps = steps
+		return res, nil
+	}
+
 	{
 		args := []string{"upgrade", "--available"}
+		if named {
+			args = []string{"upgrade"}
+		}
+		if opt.Phase == PhaseInstall {
+			// Only the cache filled by the download phase.
+			args = append(args, "--no-network")
+		}
 		if opt.DryRun {
-			args = []string{"upgrade", "--available", "--simulate"}
+			args = append(args, "--simulate")
 		}
-		args = append(append([]string{}, base...), args...)
+		args = append(append(append([]string{}, base...), args...), selected...)
 		st, err := runStep(localCtx, "apk_upgrade", cmd, args)
 		steps = append(steps, st)
 		if err != nil {
@@ -42,8 +115,249 @@ func (p *Apk) Patch(ctx context.Context, opt Options) (*PatchResult, error) {
 			return res, err
 		}
 		res.Patched = true
+		if opt.DryRun {
+			res.Plan = parseApkSimulation(st.Result.Stdout)
+		}
+	}
+
+	applyRebootCheck(res)
+	res.Steps = steps
+	return res, nil
+}
+
+// apkCacheDir is where apk looks for cached packages once the cache is
+// enabled; `apk fetch` into it makes a later `apk upgrade` use them.
+var apkCacheDir = "/etc/apk/cache"
+
+// apkKernelPatterns match the Alpine kernel flavors and their -dev packages.
+var apkKernelPatterns = []string{"linux-lts*", "linux-virt*", "linux-edge*", "linux-rpi*"}
+
+func (p *Apk) ListUpdates(ctx context.Context, opt Options) ([]PendingUpdate, error) {
+	localCtx, cancel := context.WithTimeout(ctx, opt.Timeout)
+	defer cancel()
+
+	cmd, base := prefixWithQoS("apk", nil, opt.Nice, opt.Ionice)
+	if opt.Phase != PhaseInstall {
+		args := append(append([]string{}, base...), "update")
+		if _, err := executil.Run(localCtx, cmd, args...); err != nil {
+			return nil, err
+		}
+	}
+	args := append(append([]string{}, base...), "version", "-l", "<")
+	r, err := executil.Run(localCtx, cmd, args...)
+	if err != nil {
+		return nil, err
+	}
+	return parseApkVersion(r.Stdout), nil
+}
+
+// parseApkVersion parses `apk version -l '<'` lines such as:
+//
+//	musl-1.2.4-r1                 < 1.2.4-r2
+func parseApkVersion(out string) []PendingUpdate {
+	var ups []PendingUpdate
+	for _, line := range strings.Split(out, "\n") {
+		f := strings.Fields(line)
+		if len(f) < 3 || f[1] != "<" {
+			continue
+		}
+		name, cur, ok := splitApkNameVersion(f[0])
+		if !ok {
+			continue
+		}
+		ups = append(ups, PendingUpdate{Name: name, Current: cur, Candidate: f[2]})
+	}
+	return ups
+}
+
+// apkSimulationActions maps the verbs of apk's progress lines to actions.
+var apkSimulationActions = map[string]ChangeAction{
+	"Upgrading":  ChangeUpgraded,
+	"Installing": ChangeInstalled,
+	"Purging":    ChangeRemoved,
+}
+
+// parseApkSimulation parses `apk upgrade --simulate` lines such as:
+//
+//	(1/3) Upgrading musl (1.2.4-r1 -> 1.2.4-r2)
+//	(2/3) Installing libfoo (1.0-r0)
+//	(3/3) Purging libbar (2.1-r3)
+func parseApkSimulation(out string) []PackageChange {
+	var plan []PackageChange
+	for _, line := range strings.Split(out, "\n") {
+		f := strings.Fields(line)
+		if len(f) < 4 || !strings.HasPrefix(f[0], "(") {
+			continue
+		}
+		action, ok := apkSimulationActions[f[1]]
+		if !ok {
+			continue
+		}
+		c := PackageChange{Name: f[2], Action: action}
+		vers := strings.Trim(strings.Join(f[3:], " "), "()")
+		switch action {
+		case ChangeUpgraded:
+			c.OldVersion, c.NewVersion, _ = strings.Cut(vers, " -> ")
+		case ChangeInstalled:
+			c.NewVersion = vers
+		case ChangeRemoved:
+			c.OldVersion = vers
+		}
+		plan = append(plan, c)
+	}
+	return plan
+}
+
+// splitApkNameVersion splits "name-1.2.3-r0" into name and version. apk
+// versions always end in -rN, so the name ends at the hyphen before that.
+func splitApkNameVersion(s string) (name, version string, ok bool) {
+	rel := strings.LastIndex(s, "-r")
+	if rel <= 0 {
+		return "", "", false
+	}
+	i := strings.LastIndex(s[:rel], "-")
+	if i <= 0 {
+		return "", "", false
+	}
+	return s[:i], s[i+1:], true
+}
+
+func (p *Apk) Installed(ctx context.Context) ([]InstalledPackage, error) {
+	return installedApk(ctx)
+}
+
+// InstallVersions installs with name=version constraints, which apk also
+// records in /etc/apk/world. A second `apk add name` replaces each pin with
+// a plain entry so later runs can upgrade the package again.
+func (p *Apk) InstallVersions(ctx context.Context, pkgs []PackageVersion, opt Options) (*PatchResult, error) {
+	info, _ := osinfo.Detect()
+	res := &PatchResult{Backend: p.Name(), OS: info}
+	localCtx, cancel := context.WithTimeout(ctx, opt.Timeout)
+	defer cancel()
+
+	steps := []Step{}
+	cmd, base := prefixWithQoS("apk", nil, opt.Nice, opt.Ionice)
+
+	pinned := []string{"add"}
+	plain := []string{"add"}
+	for _, pv := range pkgs {
+		pinned = append(pinned, pv.Name+"="+pv.Version)
+		plain = append(plain, pv.Name)
+	}
+	if opt.DryRun {
+		pinned = append(pinned, "--simulate")
+	}
+
+	{
+		args := append(append([]string{}, base...), pinned...)
+		st, err := runStep(localCtx, "apk_add_versions", cmd, args)
+		steps = append(steps, st)
+		if err != nil {
+			res.Steps = steps
+			return res, err
+		}
+		res.Patched = true
 	}
 
+	if !opt.DryRun {
+		args := append(append([]string{}, base...), plain...)
+		st, err := runStep(localCtx, "apk_unpin", cmd, args)
+		steps = append(steps, st)
+		if err != nil {
+			res.Steps = steps
+			return res, err
+		}
+	}
+
+	applyRebootCheck(res)
 	res.Steps = steps
 	return res, nil
 }
+
+// Cleanup empties the package cache when one is configured. apk removes
+// orphaned dependencies itself and installs one kernel per flavor, so
+// there is nothing else to clean.
+func (p *Apk) Cleanup(ctx context.Context, opt Options, c CleanupOptions) ([]Step, error) {
+	if !c.CleanCache || !fileExists(apkCacheDir) {
+		return nil, nil
+	}
+	localCtx, cancel := context.WithTimeout(ctx, opt.Timeout)
+	defer cancel()
+
+	cmd, args := prefixWithQoS("apk", []string{"cache", "clean"}, opt.Nice, opt.Ionice)
+	st, err := runStep(localCtx, "apk_cache_clean", cmd, args)
+	return []Step{st}, err
+}
+
+var apkIndexGlob = "/var/cache/apk/APKINDEX.*.tar.gz"
+
+// PublishTimes reads build times ("t:" fields) from the repository
+// indexes apk update downloaded.
+func (p *Apk) PublishTimes(ctx context.Context, ups []PendingUpdate, opt Options) ([]time.Time, error) {
+	files, _ := filepath.Glob(apkIndexGlob)
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no repository index matches %s", apkIndexGlob)
+	}
+	built := map[string]time.Time{}
+	for _, f := range files {
+		if err := readApkIndex(f, built); err != nil {
+			return nil, fmt.Errorf("%s: %w", f, err)
+		}
+	}
+	out := make([]time.Time, len(ups))
+	for i, u := range ups {
+		out[i] = built[u.Name+" "+u.Candidate]
+	}
+	return out, nil
+}
+
+// readApkIndex adds the build times of an APKINDEX.tar.gz to built, keyed
+// by "name version". The file is a signature archive and the index archive
+// concatenated as gzip streams, so it reads as one tar.
+func readApkIndex(path string, built map[string]time.Time) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gz)
+	for {
+		h, err := tr.Next()
+		if err != nil {
+			return err
+		}
+		if h.Name != "APKINDEX" {
+			continue
+		}
+		b, err := io.ReadAll(tr)
+		if err != nil {
+			return err
+		}
+		var name, version string
+		for _, line := range strings.Split(string(b), "\n") {
+			if line == "" {
+				name, version = "", ""
+				continue
+			}
+			k, v, ok := strings.Cut(line, ":")
+			if !ok {
+				continue
+			}
+			switch k {
+			case "P":
+				name = v
+			case "V":
+				version = v
+			case "t":
+				if n, err := strconv.ParseInt(v, 10, 64); err == nil && name != "" {
+					built[name+" "+version] = time.Unix(n, 0)
+				}
+			}
+		}
+		return nil
+	}
+}
@@ -1,10 +1,19 @@
 package patcher
 
 import (
+	"compress/gzip"
 	"context"
+	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
 
+	"github.com/serverpatcher/serverpatcher/internal/executil"
 	"github.com/serverpatcher/serverpatcher/internal/osinfo"
+	"github.com/serverpatcher/serverpatcher/internal/pkgver"
 )
 
 type Apt struct{}
@@ -23,7 +32,7 @@ func (p *Apt) Patch(ctx context.Context, opt Options) (*PatchResult, error) {
 	aptCmd, aptBase := prefixWithQoS("apt-get", nil, opt.Nice, opt.Ionice)
 
 	// update
-	{
+	if opt.Phase != PhaseInstall {
 		args := append(append([]string{}, aptBase...), "update")
 		st, err := runStepWithEnv(localCtx, "apt_update", aptCmd, args, env)
 		steps = append(steps, st)
@@ -33,6 +42,73 @@ func (p *Apt) Patch(ctx context.Context, opt Options) (*PatchResult, error) {
 		}
 	}
 
+	// exclude_packages and allow_kernel_updates=false are enforced with
+	// temporary holds, released again however the run ends. Dry runs leave
+	// the holds alone and drop excluded packages from the plan instead.
+	var held []string
+	var holdStep *Step
+	var err error
+	if !opt.DryRun {
+		held, holdStep, err = aptHold(localCtx, opt, env)
+	}
+	if holdStep != nil {
+		steps = append(steps, *holdStep)
+	}
+	if len(held) > 0 {
+		defer func() {
+			// localCtx may already have expired if the run timed out.
+			relCtx, relCancel := context.WithTimeout(context.Background(), 2*time.Minute)
+			defer relCancel()
+			st, _ := runStepWithEnv(relCtx, "apt_unhold", "apt-mark", append([]string{"unhold"}, held...), env)
+			res.Steps = append(res.Steps, st)
+		}()
+	}
+	if err != nil {
+		res.Steps = steps
+		return res, err
+	}
+
+	// include_packages, or security_only with min_severity: upgrade only the
+	// selected packages, never install them.
+	if len(opt.IncludePackages) > 0 || (opt.SecurityOnly && opt.MinSeverity != "") {
+		var names []string
+		var err error
+		if len(opt.IncludePackages) > 0 {
+			names, err = includedInstalled(localCtx, p, opt)
+		} else {
+			names, err = p.severeUpdates(localCtx, opt, env)
+			res.SecurityFilter = "security updates fixing CVEs of priority " + opt.MinSeverity + " or higher"
+		}
+		if err != nil {
+			res.Steps = steps
+			return res, err
+		}
+		if len(names) > 0 {
+			args := []string{
+				"-y",
+				"-o", "Dpkg::Options::=--force-confdef",
+				"-o", "Dpkg::Options::=--force-confold",
+			}
+			if opt.DryRun {
+				args = append(args, "-s")
+			}
+			args = append(args, aptPhaseArgs(opt.Phase)...)
+			args = append(append(args, "install", "--only-upgrade"), names...)
+			args = append(append([]string{}, aptBase...), args...)
+			st, err := runStepWithEnv(localCtx, "apt_only_upgrade", aptCmd, args, env)
+			steps = append(steps, st)
+			if err != nil {
+				res.Steps = steps
+				return res, err
+			}
+			res.Patched = opt.Phase != PhaseDownload
+			if opt.DryRun {
+				res.Plan = aptDropExcluded(parseAptSimulation(st.Result.Stdout), opt)
+			}
+		}
+		goto REBOOT
+	}
+
 	// upgrade
 	{
 		if opt.SecurityOnly {
@@ -41,13 +117,17 @@ func (p *Apt) Patch(ctx context.Context, opt Options) (*PatchResult, error) {
 				if opt.DryRun {
 					uBase = append(uBase, "--dry-run")
 				}
+				if opt.Phase == PhaseDownload {
+					uBase = append(uBase, "--download-only")
+				}
+				res.SecurityFilter = "unattended-upgrade"
 				st, err := runStepWithEnv(localCtx, "apt_unattended_upgrade", uCmd, uBase, env)
 				steps = append(steps, st)
 				if err != nil {
 					res.Steps = steps
 					return res, err
 				}
-				res.Patched = true
+				res.Patched = opt.Phase != PhaseDownload
 				goto REBOOT
 			}
 		}
@@ -60,16 +140,10 @@ func (p *Apt) Patch(ctx context.Context, opt Options) (*PatchResult, error) {
 		if opt.DryRun {
 			args = append(args, "-s")
 		}
+		args = append(args, aptPhaseArgs(opt.Phase)...)
 		// Best practice: full-upgrade handles dependency transitions.
 		args = append(args, "full-upgrade")
 
-		// NOTE: Enforcing excludes on apt in a non-invasive way is non-trivial (requires pin/hold).
-		// We keep exclude_packages as documentation-only for apt to avoid making destructive system changes.
-		if !opt.AllowKernel {
-			// Informational only.
-			res.RebootReason = "kernel updates disallowed by config; enforce via apt pin/hold if needed"
-		}
-
 		args = append(append([]string{}, aptBase...), args...)
 		st, err := runStepWithEnv(localCtx, "apt_full_upgrade", aptCmd, args, env)
 		steps = append(steps, st)
@@ -77,7 +151,10 @@ func (p *Apt) Patch(ctx context.Context, opt Options) (*PatchResult, error) {
 			res.Steps = steps
 			return res, err
 		}
-		res.Patched = true
+		res.Patched = opt.Phase != PhaseDownload
+		if opt.DryRun {
+			res.Plan = aptDropExcluded(parseAptSimulation(st.Result.Stdout), opt)
+		}
 	}
 
 REBOOT:
@@ -91,6 +168,495 @@ REBOOT:
 		}
 	}
 
+	applyRebootCheck(res)
 	res.Steps = steps
 	return res, nil
 }
+
+// aptPhaseArgs fetches without installing, or installs strictly from the
+// archive cache: a package that was not downloaded fails the install phase
+// instead of being fetched inside the window.
+func aptPhaseArgs(ph Phase) []string {
+	switch ph {
+	case PhaseDownload:
+		return []string{"--download-only"}
+	case PhaseInstall:
+		return []string{"--no-download"}
+	}
+	return nil
+}
+
+// aptKernelPatterns match kernel images and the metapackages that pull new
+// kernels in on Debian and Ubuntu.
+var aptKernelPatterns = []string{
+	"linux-image-*",
+	"linux-headers-*",
+	"linux-modules-*",
+	"linux-generic*",
+	"linux-virtual*",
+	"linux-lowlatency*",
+	"linux-aws*",
+	"linux-azure*",
+	"linux-gcp*",
+	"linux-oracle*",
+	"linux-kvm*",
+}
+
+// aptHold holds installed packages matching exclude_packages, plus kernel
+// packages when kernel updates are disallowed. It returns only the packages
+// it newly held, so holds set by the administrator are never released.
+func aptHold(ctx context.Context, opt Options, env []string) ([]string, *Step, error) {
+	patterns := append([]string{}, opt.ExcludePackages...)
+	if !opt.AllowKernel {
+		patterns = append(patterns, aptKernelPatterns...)
+	}
+	if len(patterns) == 0 {
+		return nil, nil, nil
+	}
+
+	pkgs, err := installedDpkg(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	r, err := runCommandWithEnv(ctx, "apt-mark", []string{"showhold"}, env)
+	if err != nil {
+		return nil, nil, err
+	}
+	already := map[string]bool{}
+	for _, n := range strings.Fields(r.Stdout) {
+		already[n] = true
+	}
+
+	var hold []string
+	for _, n := range expandPatterns(pkgs, patterns) {
+		if !already[n] {
+			hold = append(hold, n)
+		}
+	}
+	if len(hold) == 0 {
+		return nil, nil, nil
+	}
+	// Return the list even on failure: apt-mark may have held some of them.
+	st, err := runStepWithEnv(ctx, "apt_hold", "apt-mark", append([]string{"hold"}, hold...), env)
+	return hold, &st, err
+}
+
+// aptDropExcluded leaves the packages a real run would hold out of a
+// simulated plan.
+func aptDropExcluded(plan []PackageChange, opt Options) []PackageChange {
+	exclude := excludePatterns("apt", opt)
+	if len(exclude) == 0 {
+		return plan
+	}
+	var out []PackageChange
+	for _, c := range plan {
+		if !matchAny(c.Name, exclude) {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+func (p *Apt) ListUpdates(ctx context.Context, opt Options) ([]PendingUpdate, error) {
+	localCtx, cancel := context.WithTimeout(ctx, opt.Timeout)
+	defer cancel()
+
+	env := append(os.Environ(), "DEBIAN_FRONTEND=noninteractive", "LC_ALL=C")
+
+	// The install phase lists what the download phase fetched.
+	if opt.Phase != PhaseInstall {
+		aptCmd, aptBase := prefixWithQoS("apt-get", nil, opt.Nice, opt.Ionice)
+		args := append(append([]string{}, aptBase...), "update")
+		if _, err := runCommandWithEnv(localCtx, aptCmd, args, env); err != nil {
+			return nil, err
+		}
+	}
+	r, err := runCommandWithEnv(localCtx, "apt", []string{"list", "--upgradable"}, env)
+	if err != nil {
+		return nil, err
+	}
+	return parseAptUpgradable(r.Stdout), nil
+}
+
+// severeUpdates selects the pending security updates that fix a CVE of at
+// least opt.MinSeverity, as rated by the distribution's security tracker.
+func (p *Apt) severeUpdates(ctx context.Context, opt Options, env []string) ([]string, error) {
+	r, err := runCommandWithEnv(ctx, "apt", []string{"list", "--upgradable"}, append(env, "LC_ALL=C"))
+	if err != nil {
+		return nil, err
+	}
+	ups, err := FilterSeverity(ctx, p, FilterUpdates(p.Name(), parseAptUpgradable(r.Stdout), opt), opt)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(ups))
+	for _, u := range ups {
+		names = append(names, u.Name)
+	}
+	return names, nil
+}
+
+// parseAptUpgradable parses `apt list --upgradable` lines such as:
+//
+//	libssl3/jammy-updates,jammy-security 3.0.2-0ubuntu1.12 amd64 [upgradable from: 3.0.2-0ubuntu1.10]
+func parseAptUpgradable(out string) []PendingUpdate {
+	var ups []PendingUpdate
+	for _, line := range strings.Split(out, "\n") {
+		f := strings.Fields(line)
+		if len(f) < 3 || !strings.Contains(f[0], "/") {
+			continue
+		}
+		name, repo, _ := strings.Cut(f[0], "/")
+		u := PendingUpdate{
+			Name:       name,
+			Arch:       f[2],
+			Candidate:  f[1],
+			Repository: repo,
+			Security:   strings.Contains(repo, "security"),
+		}
+		if i := strings.Index(line, "[upgradable from: "); i >= 0 {
+			u.Current = strings.TrimSuffix(strings.TrimSpace(line[i+len("[upgradable from: "):]), "]")
+		}
+		ups = append(ups, u)
+	}
+	return ups
+}
+
+// parseAptSimulation parses the Inst/Remv lines of `apt-get -s`:
+//
+//	Inst libssl3 [3.0.2-0ubuntu1.10] (3.0.2-0ubuntu1.12 Ubuntu:22.04/jammy-updates [amd64])
+//	Inst linux-image-5.15.0-91-generic (5.15.0-91.101 Ubuntu:22.04/jammy-updates [amd64])
+//	Remv libfoo1 [1.2-1]
+func parseAptSimulation(out string) []PackageChange {
+	var plan []PackageChange
+	for _, line := range strings.Split(out, "\n") {
+		f := strings.Fields(line)
+		if len(f) < 2 || (f[0] != "Inst" && f[0] != "Remv") {
+			continue
+		}
+		c := PackageChange{Name: f[1]}
+		rest := strings.TrimSpace(strings.TrimPrefix(strings.TrimPrefix(line, f[0]), " "+f[1]))
+		if strings.HasPrefix(rest, "[") {
+			if i := strings.Index(rest, "]"); i > 0 {
+				c.OldVersion = rest[1:i]
+				rest = strings.TrimSpace(rest[i+1:])
+			}
+		}
+		if f[0] == "Remv" {
+			c.Action = ChangeRemoved
+			plan = append(plan, c)
+			continue
+		}
+		if strings.HasPrefix(rest, "(") {
+			inner := rest[1:]
+			if i := strings.Index(inner, ")"); i >= 0 {
+				inner = inner[:i]
+			}
+			if v := strings.Fields(inner); len(v) > 0 {
+				c.NewVersion = v[0]
+			}
+			if i := strings.LastIndex(inner, "["); i >= 0 {
+				c.Arch = strings.TrimSuffix(inner[i+1:], "]")
+			}
+		}
+		c.Action = ChangeUpgraded
+		if c.OldVersion == "" {
+			c.Action = ChangeInstalled
+		}
+		plan = append(plan, c)
+	}
+	return plan
+}
+
+func (p *Apt) Installed(ctx context.Context) ([]InstalledPackage, error) {
+	return installedDpkg(ctx)
+}
+
+func (p *Apt) InstallVersions(ctx context.Context, pkgs []PackageVersion, opt Options) (*PatchResult, error) {
+	info, _ := osinfo.Detect()
+	res := &PatchResult{Backend: p.Name(), OS: info}
+	localCtx, cancel := context.WithTimeout(ctx, opt.Timeout)
+	defer cancel()
+
+	env := append(os.Environ(), "DEBIAN_FRONTEND=noninteractive")
+	aptCmd, aptBase := prefixWithQoS("apt-get", nil, opt.Nice, opt.Ionice)
+
+	args := []string{
+		"-y", "--allow-downgrades",
+		"-o", "Dpkg::Options::=--force-confdef",
+		"-o", "Dpkg::Options::=--force-confold",
+	}
+	if opt.DryRun {
+		args = append(args, "-s")
+	}
+	args = append(args, "install")
+	for _, pv := range pkgs {
+		name := pv.Name
+		// Architecture-independent packages take no :arch qualifier.
+		if pv.Arch != "" && pv.Arch != "all" {
+			name += ":" + pv.Arch
+		}
+		args = append(args, name+"="+pv.Version)
+	}
+	args = append(append([]string{}, aptBase...), args...)
+	st, err := runStepWithEnv(localCtx, "apt_install_versions", aptCmd, args, env)
+	res.Steps = []Step{st}
+	if err != nil {
+		return res, err
+	}
+	res.Patched = true
+
+	applyRebootCheck(res)
+	return res, nil
+}
+
+var dpkgUpdatesDir = "/var/lib/dpkg/updates"
+
+// Recover finishes an interrupted dpkg run. Until `dpkg --configure -a`
+// has run, every apt-get call fails with "dpkg was interrupted".
+func (p *Apt) Recover(ctx context.Context, opt Options) ([]Step, error) {
+	localCtx, cancel := context.WithTimeout(ctx, opt.Timeout)
+	defer cancel()
+
+	env := append(os.Environ(), "DEBIAN_FRONTEND=noninteractive")
+	st, ok := dpkgAudit(localCtx, "dpkg_audit", env)
+	steps := []Step{st}
+	if ok {
+		return steps, nil
+	}
+
+	for _, c := range []struct {
+		name string
+		cmd  string
+		args []string
+	}{
+		{"dpkg_configure_pending", "dpkg", []string{"--force-confdef", "--force-confold", "--configure", "-a"}},
+		{"apt_fix_broken", "apt-get", []string{"-y", "-o", "Dpkg::Options::=--force-confdef", "-o", "Dpkg::Options::=--force-confold", "-f", "install"}},
+	} {
+		st, err := runStepWithEnv(localCtx, c.name, c.cmd, c.args, env)
+		steps = append(steps, st)
+		if err != nil {
+			return steps, err
+		}
+	}
+
+	st, ok = dpkgAudit(localCtx, "dpkg_audit_after", env)
+	steps = append(steps, st)
+	if !ok {
+		return steps, fmt.Errorf("dpkg database is still inconsistent after recovery; see the dpkg_audit_after step")
+	}
+	return steps, nil
+}
+
+// dpkgAudit reports whether dpkg considers its database consistent: no
+// half-installed packages and no pending journal entries.
+func dpkgAudit(ctx context.Context, name string, env []string) (Step, bool) {
+	st, _ := runStepWithEnv(ctx, name, "dpkg", []string{"--audit"}, env)
+	if st.Result == nil || st.Result.Stdout != "" {
+		return st, false
+	}
+	entries, _ := os.ReadDir(dpkgUpdatesDir)
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Name(), "tmp.") {
+			return st, false
+		}
+	}
+	return st, true
+}
+
+// Cleanup purges kernels beyond the newest c.KeepKernels and the running
+// one, then autoremoves orphans and empties the package cache. Kept
+// kernels are protected from autoremove, whose own kernel policy keeps
+// fewer.
+func (p *Apt) Cleanup(ctx context.Context, opt Options, c CleanupOptions) ([]Step, error) {
+	localCtx, cancel := context.WithTimeout(ctx, opt.Timeout)
+	defer cancel()
+
+	env := append(os.Environ(), "DEBIAN_FRONTEND=noninteractive")
+	aptCmd, aptBase := prefixWithQoS("apt-get", nil, opt.Nice, opt.Ionice)
+	var steps []Step
+
+	var protect []string
+	if c.KeepKernels > 0 {
+		pkgs, err := installedDpkg(localCtx)
+		if err != nil {
+			return steps, fmt.Errorf("list installed kernels: %w", err)
+		}
+		var releases []string
+		for _, pkg := range pkgs {
+			rel := strings.TrimPrefix(strings.TrimPrefix(pkg.Name, "linux-image-unsigned-"), "linux-image-")
+			if rel != pkg.Name && rel != "" && rel[0] >= '0' && rel[0] <= '9' {
+				releases = append(releases, rel)
+			}
+		}
+		remove, kept, err := oldKernels(releases, c.KeepKernels)
+		if err != nil {
+			return steps, err
+		}
+		for _, rel := range kept {
+			protect = append(protect, "-o", "APT::NeverAutoRemove::=^linux-.*-"+regexp.QuoteMeta(rel)+"$")
+		}
+		var names []string
+		for _, pkg := range pkgs {
+			for _, rel := range remove {
+				if strings.HasPrefix(pkg.Name, "linux-") && strings.HasSuffix(pkg.Name, "-"+rel) {
+					names = append(names, pkg.Name)
+				}
+			}
+		}
+		if len(names) > 0 {
+			args := append(append(append([]string{}, aptBase...), "-y", "purge"), names...)
+			st, err := runStepWithEnv(localCtx, "apt_purge_old_kernels", aptCmd, args, env)
+			steps = append(steps, st)
+			if err != nil {
+				return steps, err
+			}
+		}
+	}
+	if c.Autoremove {
+		args := append(append(append([]string{}, aptBase...), protect...), "-y", "autoremove", "--purge")
+		st, err := runStepWithEnv(localCtx, "apt_autoremove", aptCmd, args, env)
+		steps = append(steps, st)
+		if err != nil {
+			return steps, err
+		}
+	}
+	if c.CleanCache {
+		st, err := runStepWithEnv(localCtx, "apt_clean", aptCmd, append(append([]string{}, aptBase...), "clean"), env)
+		steps = append(steps, st)
+		if err != nil {
+			return steps, err
+		}
+	}
+	return steps, nil
+}
+
+var (
+	cveRe             = regexp.MustCompile(`CVE-\d{4}-\d{4,}`)
+	debAdvisoryRe     = regexp.MustCompile(`\b(?:DSA|DLA|USN)-\d+-\d+\b`)
+	changelogHeaderRe = regexp.MustCompile(`^\S+ \(([^)]+)\) [^;]*;.*\burgency=\w+`)
+	aptDocDir         = "/usr/share/doc"
+)
+
+// aptAdvisoryBudget bounds the time the network lookups of one advisory
+// lookup take together: `apt-get changelog` fetches and CVE priorities.
+const aptAdvisoryBudget = 2 * time.Minute
+
+// Advisories reads the Debian changelog entries between the old and new
+// version of each changed package and reports those that mention CVEs or
+// DSA/DLA/USN IDs. The installed changelog is used when it is already at
+// the new version (after a run); otherwise it is fetched with `apt-get
+// changelog` (dry runs, images without /usr/share/doc). An entry's
+// severity is the highest priority the security tracker gives its CVEs;
+// the changelog urgency only schedules the upload. Network lookups share
+// aptAdvisoryBudget; what is left when it runs out is not looked up.
+func (p *Apt) Advisories(ctx context.Context, changes []PackageChange, opt Options) ([]Advisory, error) {
+	fetchCtx, cancel := context.WithTimeout(ctx, aptAdvisoryBudget)
+	defer cancel()
+
+	var advs []Advisory
+	var err error
+	for _, c := range changes {
+		if c.Action == ChangeRemoved || c.NewVersion == "" {
+			continue
+		}
+		text := localChangelog(c.Name)
+		if firstChangelogVersion(text) != c.NewVersion {
+			if fetchCtx.Err() != nil {
+				err = fmt.Errorf("changelog lookups stopped after %s: %w", aptAdvisoryBudget, fetchCtx.Err())
+				continue
+			}
+			if r, rerr := executil.Run(fetchCtx, "apt-get", "changelog", c.Name+"="+c.NewVersion); rerr == nil {
+				text = r.Stdout
+			}
+		}
+		advs = append(advs, parseDebChangelog(c.Name, text, c.OldVersion)...)
+	}
+
+	var cves []string
+	for _, a := range advs {
+		for _, cve := range a.CVEs {
+			cves = appendUnique(cves, cve)
+		}
+	}
+	if len(cves) == 0 {
+		return advs, err
+	}
+	info, _ := osinfo.Detect()
+	prio, perr := cvePriorities(fetchCtx, info, cves)
+	if perr != nil && err == nil {
+		err = fmt.Errorf("CVE priority lookup: %w", perr)
+	}
+	for i := range advs {
+		for _, cve := range advs[i].CVEs {
+			if severityRank[prio[cve]] > severityRank[advs[i].Severity] {
+				advs[i].Severity = prio[cve]
+			}
+		}
+	}
+	return advs, err
+}
+
+// localChangelog returns the installed changelog of pkg, or "".
+func localChangelog(pkg string) string {
+	for _, name := range []string{"changelog.Debian.gz", "changelog.gz"} {
+		f, err := os.Open(filepath.Join(aptDocDir, pkg, name))
+		if err != nil {
+			continue
+		}
+		defer f.Close()
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			continue
+		}
+		b, err := io.ReadAll(zr)
+		if err != nil {
+			continue
+		}
+		return string(b)
+	}
+	return ""
+}
+
+func firstChangelogVersion(text string) string {
+	for _, line := range strings.Split(text, "\n") {
+		if m := changelogHeaderRe.FindStringSubmatch(line); m != nil {
+			return m[1]
+		}
+	}
+	return ""
+}
+
+// parseDebChangelog returns an Advisory for each entry newer than since
+// (all entries when since is empty) that references CVEs or advisory IDs.
+func parseDebChangelog(pkg, text, since string) []Advisory {
+	var advs []Advisory
+	var cur *Advisory
+	flush := func() {
+		if cur != nil && (cur.ID != "" || len(cur.CVEs) > 0) {
+			advs = append(advs, *cur)
+		}
+		cur = nil
+	}
+	for _, line := range strings.Split(text, "\n") {
+		if m := changelogHeaderRe.FindStringSubmatch(line); m != nil {
+			flush()
+			if since != "" && pkgver.Compare(m[1], since) <= 0 {
+				break
+			}
+			cur = &Advisory{Package: pkg, Version: m[1]}
+			continue
+		}
+		if cur == nil {
+			continue
+		}
+		if cur.ID == "" {
+			cur.ID = debAdvisoryRe.FindString(line)
+		}
+		for _, cve := range cveRe.FindAllString(line, -1) {
+			cur.CVEs = appendUnique(cur.CVEs, cve)
+		}
+	}
+	flush()
+	return advs
+}
@@ -0,0 +1,16 @@
+package patcher
+
+// cacheDirs are where each backend keeps downloaded packages.
+var cacheDirs = map[string]string{
+	"apt":    "/var/cache/apt/archives",
+	"dnf":    "/var/cache/dnf",
+	"yum":    "/var/cache/yum",
+	"zypper": "/var/cache/zypp/packages",
+	"pacman": "/var/cache/pacman/pkg",
+	"apk":    apkCacheDir,
+}
+
+// CacheDir returns the package cache of backend, or "" if unknown.
+func CacheDir(backend string) string {
+	return cacheDirs[backend]
+}
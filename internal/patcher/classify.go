@@ -0,0 +1,136 @@
+package patcher
+
+import (
+	"strings"
+
+	"github.com/serverpatcher/serverpatcher/internal/executil"
+)
+
+// Category is the kind of failure a step ran into.
+type Category string
+
+const (
+	CategoryNetwork   Category = "network"
+	CategoryLock      Category = "lock"
+	CategorySignature Category = "signature"
+	CategoryDiskSpace Category = "disk_space"
+	CategoryConflict  Category = "dependency_conflict"
+	CategoryUnknown   Category = "unknown"
+)
+
+// Transient reports whether retrying the same command may succeed.
+func (c Category) Transient() bool {
+	return c == CategoryNetwork || c == CategoryLock
+}
+
+type classifyRule struct {
+	category  Category
+	exitCodes []int
+	patterns  []string // lower case, matched against stdout and stderr
+}
+
+// classifyRules are checked per backend first, then commonRules. Order
+// matters: a lock or disk error often also mentions a failed download.
+var classifyRules = map[string][]classifyRule{
+	"apt": {
+		{category: CategoryLock, patterns: []string{"could not get lock", "unable to acquire the dpkg frontend lock", "unable to lock the administration directory", "unable to lock directory"}},
+		{category: CategorySignature, patterns: []string{"no_pubkey", "signatures couldn't be verified", "is not signed", "badsig"}},
+		{category: CategoryConflict, patterns: []string{"unmet dependencies", "held broken packages", "you have held broken packages", "trying to overwrite"}},
+		{category: CategoryNetwork, patterns: []string{"temporary failure resolving", "could not resolve", "failed to fetch", "hash sum mismatch", "unable to connect to"}},
+	},
+	"dnf": {
+		{category: CategoryLock, exitCodes: []int{200}, patterns: []string{"waiting for process with pid"}},
+		{category: CategorySignature, patterns: []string{"gpg check failed", "public key for", "is not signed", "nokey"}},
+		{category: CategoryConflict, patterns: []string{"nothing provides", "conflicts with", "cannot install both", "problem: ", "file conflicts"}},
+		{category: CategoryNetwork, patterns: []string{"cannot download", "failed to download metadata", "curl error", "no more mirrors to try", "librepo"}},
+	},
+	"yum": {
+		{category: CategoryLock, patterns: []string{"another app is currently holding the yum lock", "existing lock /var/run/yum.pid"}},
+		{category: CategorySignature, patterns: []string{"public key for", "gpg key retrieval failed", "is not signed", "nokey"}},
+		{category: CategoryConflict, patterns: []string{"requires:", "conflicts with", "multilib version problems", "transaction check error"}},
+		{category: CategoryNetwork, patterns: []string{"cannot find a valid baseurl", "cannot retrieve repository metadata", "no more mirrors to try", "errno 14"}},
+	},
+	"zypper": {
+		{category: CategoryLock, exitCodes: []int{7}, patterns: []string{"system management is locked"}},
+		{category: CategoryNetwork, exitCodes: []int{106}, patterns: []string{"download (curl) error", "valid metadata not found", "repository is not available"}},
+		{category: CategorySignature, patterns: []string{"signature verification failed", "gpg check failed", "unknown gpg key", "is not signed"}},
+		{category: CategoryConflict, patterns: []string{"problem: ", "nothing provides", "conflicts with", "file conflicts"}},
+	},
+	"pacman": {
+		{category: CategoryLock, patterns: []string{"unable to lock database"}},
+		{category: CategorySignature, patterns: []string{"invalid or corrupted package (pgp signature)", "signature from", "unknown trust", "key could not be looked up"}},
+		{category: CategoryConflict, patterns: []string{"failed to prepare transaction", "conflicting files", "unresolvable package conflicts", "could not satisfy dependencies"}},
+		{category: CategoryNetwork, patterns: []string{"failed retrieving file", "failed to synchronize", "could not resolve host", "download library error"}},
+	},
+	"apk": {
+		{category: CategoryLock, patterns: []string{"unable to lock database"}},
+		{category: CategorySignature, patterns: []string{"untrusted signature", "bad signature", "untrusted key"}},
+		{category: CategoryConflict, patterns: []string{"unsatisfiable constraints", "breaks:", "conflicts:"}},
+		{category: CategoryNetwork, patterns: []string{"temporary error (try again later)", "network error", "dns lookup error", "could not connect"}},
+	},
+}
+
+var commonRules = []classifyRule{
+	{category: CategoryDiskSpace, patterns: []string{"no space left on device", "not enough free space", "enough free space in", "more space needed", "needs more space", "disk requirements", "insufficient space"}},
+	{category: CategoryLock, patterns: []string{"is another process using it", "database is locked"}},
+	{category: CategoryNetwork, patterns: []string{"temporary failure in name resolution", "connection timed out", "connection refused", "network is unreachable", "could not resolve host", "operation timed out"}},
+}
+
+// stepBackends maps step name prefixes that are not backend names.
+var stepBackends = map[string]string{
+	"dpkg": "apt",
+}
+
+// stepBackend derives the backend from a step name such as "apt_update".
+func stepBackend(name string) string {
+	prefix, _, _ := strings.Cut(name, "_")
+	if b, ok := stepBackends[prefix]; ok {
+		return b
+	}
+	return prefix
+}
+
+// Classify sorts a failed command into a Category using the rules of
+// backend. Disk space is checked first: a full disk makes downloads and
+// lock files fail too.
+func Classify(backend string, r *executil.Result) Category {
+	if r == nil {
+		return CategoryUnknown
+	}
+	out := strings.ToLower(r.Stdout + "\n" + r.Stderr)
+	match := func(rules []classifyRule) Category {
+		for _, rule := range rules {
+			for _, code := range rule.exitCodes {
+				if r.ExitCode == code {
+					return rule.category
+				}
+			}
+			for _, pat := range rule.patterns {
+				if strings.Contains(out, pat) {
+					return rule.category
+				}
+			}
+		}
+		return ""
+	}
+	if c := match(commonRules[:1]); c != "" {
+		return c
+	}
+	if c := match(classifyRules[backend]); c != "" {
+		return c
+	}
+	if c := match(commonRules[1:]); c != "" {
+		return c
+	}
+	return CategoryUnknown
+}
+
+// FailureCategory returns the category of the last failed step.
+func FailureCategory(steps []Step) Category {
+	for i := len(steps) - 1; i >= 0; i-- {
+		if steps[i].Category != "" {
+			return steps[i].Category
+		}
+	}
+	return ""
+}
@@ -0,0 +1,103 @@
+package patcher
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"syscall"
+
+	"github.com/serverpatcher/serverpatcher/internal/pkgver"
+	"github.com/serverpatcher/serverpatcher/internal/reboot"
+)
+
+// CleanupOptions selects what a cleanup removes. KeepKernels is the number
+// of newest kernels kept besides the running one; 0 leaves kernels alone.
+type CleanupOptions struct {
+	KeepKernels int
+	Autoremove  bool
+	CleanCache  bool
+}
+
+// Cleaner is implemented by backends that can remove old kernels, orphaned
+// dependencies and cached packages after patching. Cleanup is never run in
+// dry runs.
+type Cleaner interface {
+	Cleanup(ctx context.Context, opt Options, c CleanupOptions) ([]Step, error)
+}
+
+// CleanupResult is the outcome of a cleanup: the packages it removed and
+// the disk space it gave back on /, /var, /boot and the package cache.
+type CleanupResult struct {
+	Removed    []PackageChange
+	BytesFreed uint64
+	Steps      []Step
+	Err        error
+}
+
+// RunCleanup runs the cleanup of p, which must implement Cleaner, and
+// diffs installed packages and free space around it.
+func RunCleanup(ctx context.Context, p Patcher, opt Options, c CleanupOptions) CleanupResult {
+	var out CleanupResult
+	paths := []string{"/", "/var", "/boot", CacheDir(p.Name())}
+	free := freeSpace(paths)
+	before, beforeErr := p.Installed(ctx)
+
+	out.Steps, out.Err = p.(Cleaner).Cleanup(ctx, opt, c)
+
+	if beforeErr == nil {
+		if after, err := p.Installed(ctx); err == nil {
+			for _, ch := range DiffInstalled(before, after) {
+				if ch.Action == ChangeRemoved {
+					out.Removed = append(out.Removed, ch)
+				}
+			}
+		}
+	}
+	for dev, after := range freeSpace(paths) {
+		if b, ok := free[dev]; ok && after > b {
+			out.BytesFreed += after - b
+		}
+	}
+	return out
+}
+
+// freeSpace returns the available bytes per filesystem holding paths,
+// keyed by device so that shared filesystems are counted once.
+func freeSpace(paths []string) map[uint64]uint64 {
+	out := map[uint64]uint64{}
+	for _, p := range paths {
+		var st syscall.Stat_t
+		var fs syscall.Statfs_t
+		if p == "" || syscall.Stat(p, &st) != nil || syscall.Statfs(p, &fs) != nil {
+			continue
+		}
+		out[uint64(st.Dev)] = fs.Bavail * uint64(fs.Bsize)
+	}
+	return out
+}
+
+// oldKernels splits installed kernel releases into those to remove and
+// those to keep: the keep newest plus the running one. keep <= 0 keeps
+// all of them. Nothing is removed if the running kernel is unknown.
+func oldKernels(releases []string, keep int) (remove, kept []string, err error) {
+	if keep <= 0 {
+		return nil, releases, nil
+	}
+	running, err := reboot.RunningKernel()
+	if err == nil && running == "" {
+		err = fmt.Errorf("empty kernel release")
+	}
+	if err != nil {
+		return nil, releases, fmt.Errorf("cannot tell the running kernel, so no kernels are removed: %w", err)
+	}
+	sorted := append([]string{}, releases...)
+	sort.Slice(sorted, func(i, j int) bool { return pkgver.Compare(sorted[i], sorted[j]) > 0 })
+	for i, r := range sorted {
+		if i < keep || r == running {
+			kept = append(kept, r)
+		} else {
+			remove = append(remove, r)
+		}
+	}
+	return remove, kept, nil
+}
@@ -0,0 +1,60 @@
+package patcher
+
+import "context"
+
+// SourceResult is the outcome of patching one package source.
+type SourceResult struct {
+	Source  string
+	Result  *PatchResult
+	Changes []PackageChange
+	Err     error
+	// SnapshotErr is set when installed packages could not be listed, in
+	// which case Changes is empty even if the source changed packages.
+	SnapshotErr error
+}
+
+// RunSource patches a single source and diffs its installed packages
+// before and after.
+func RunSource(ctx context.Context, p Patcher, opt Options) SourceResult {
+	return RunSourceFunc(ctx, p, func(ctx context.Context) (*PatchResult, error) {
+		return p.Patch(ctx, opt)
+	})
+}
+
+// RunSourceFunc is RunSource with fn in place of p.Patch, for operations
+// such as installing exact versions.
+func RunSourceFunc(ctx context.Context, p Patcher, fn func(context.Context) (*PatchResult, error)) SourceResult {
+	sr := SourceResult{Source: p.Name()}
+	before, err := p.Installed(ctx)
+	sr.SnapshotErr = err
+
+	sr.Result, sr.Err = fn(ctx)
+	// Diff even if Patch failed: a partial upgrade still changed the host.
+	if sr.Result != nil && len(sr.Result.Changes) > 0 {
+		sr.Changes = sr.Result.Changes
+	} else if sr.SnapshotErr == nil {
+		after, err := p.Installed(ctx)
+		if err != nil {
+			sr.SnapshotErr = err
+		} else {
+			sr.Changes = DiffInstalled(before, after)
+		}
+	}
+	return sr
+}
+
+// RunComposite patches the sources in order. Each source gets its own
+// opt.Timeout and a failing source does not stop the ones after it.
+func RunComposite(ctx context.Context, sources []Patcher, opt Options) []SourceResult {
+	results := make([]SourceResult, 0, len(sources))
+	for _, p := range sources {
+		if ctx.Err() != nil {
+			results = append(results, SourceResult{Source: p.Name(), Err: ctx.Err()})
+			continue
+		}
+		srcCtx, cancel := context.WithTimeout(ctx, opt.Timeout)
+		results = append(results, RunSource(srcCtx, p, opt))
+		cancel()
+	}
+	return results
+}
@@ -0,0 +1,137 @@
+package patcher
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/serverpatcher/serverpatcher/internal/osinfo"
+)
+
+var (
+	ubuntuCVEURL     = "https://ubuntu.com/security/cves/%s.json"
+	debianTrackerURL = "https://security-tracker.debian.org/tracker/data/json"
+)
+
+// cvePriorities returns the severity the distribution's security team gave
+// each of cves: the Ubuntu CVE tracker's priority on Ubuntu and its
+// derivatives, the Debian security tracker's urgency for the host's
+// release elsewhere. CVEs without a rating are left out.
+func cvePriorities(ctx context.Context, info *osinfo.Info, cves []string) (map[string]string, error) {
+	switch {
+	case info == nil:
+		return nil, fmt.Errorf("unknown distribution")
+	case info.IsUbuntu() || info.IsLike("ubuntu"):
+		return ubuntuPriorities(ctx, cves)
+	case info.IsDebianLike():
+		if info.Codename == "" {
+			return nil, fmt.Errorf("no VERSION_CODENAME in /etc/os-release to look up the Debian release")
+		}
+		return debianUrgencies(ctx, info.Codename, cves)
+	}
+	return nil, fmt.Errorf("no security tracker for %s", info.ID)
+}
+
+// ubuntuPriorities fetches the Ubuntu CVE tracker entry of each CVE. CVEs
+// the tracker does not know are skipped.
+func ubuntuPriorities(ctx context.Context, cves []string) (map[string]string, error) {
+	out := map[string]string{}
+	for _, cve := range cves {
+		var doc struct {
+			Priority string `json:"priority"`
+		}
+		if err := getJSON(ctx, fmt.Sprintf(ubuntuCVEURL, cve), &doc); err != nil {
+			if ctx.Err() != nil {
+				return out, ctx.Err()
+			}
+			continue
+		}
+		if sev := distroSeverity(doc.Priority); sev != "" {
+			out[cve] = sev
+		}
+	}
+	return out, nil
+}
+
+// debianUrgencies reads the Debian security tracker's per-release
+// urgencies. The tracker data is large, so it is decoded one source
+// package at a time; a CVE listed under several packages takes its highest
+// urgency.
+func debianUrgencies(ctx context.Context, codename string, cves []string) (map[string]string, error) {
+	want := map[string]bool{}
+	for _, cve := range cves {
+		want[cve] = true
+	}
+	resp, err := httpGet(ctx, debianTrackerURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	out := map[string]string{}
+	dec := json.NewDecoder(resp.Body)
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+	for dec.More() {
+		if _, err := dec.Token(); err != nil {
+			return out, err
+		}
+		var issues map[string]struct {
+			Releases map[string]struct {
+				Urgency string `json:"urgency"`
+			} `json:"releases"`
+		}
+		if err := dec.Decode(&issues); err != nil {
+			return out, err
+		}
+		for cve, is := range issues {
+			if !want[cve] {
+				continue
+			}
+			if sev := distroSeverity(is.Releases[codename].Urgency); severityRank[sev] > severityRank[out[cve]] {
+				out[cve] = sev
+			}
+		}
+	}
+	return out, nil
+}
+
+// distroSeverity maps Debian urgencies and Ubuntu priorities onto advisory
+// severities. Debian's "unimportant" and Ubuntu's "negligible" count as
+// low; "not yet assigned" and "untriaged" are unknown.
+func distroSeverity(s string) string {
+	s = strings.TrimRight(strings.ToLower(strings.TrimSpace(s)), "*")
+	if s == "unimportant" || s == "negligible" {
+		return "low"
+	}
+	return NormalizeSeverity(s)
+}
+
+func getJSON(ctx context.Context, url string, v any) error {
+	resp, err := httpGet(ctx, url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// httpGet fetches url, treating any status but 200 as an error.
+func httpGet(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return resp, nil
+}
@@ -2,6 +2,8 @@ package patcher
 
 import (
 	"context"
+	"os"
+	"strings"
 	"time"
 
 	"github.com/serverpatcher/serverpatcher/internal/executil"
@@ -21,7 +23,7 @@ func (p *Dnf) Patch(ctx context.Context, opt Options) (*PatchResult, error) {
 	steps := []Step{}
 	cmd, base := prefixWithQoS("dnf", nil, opt.Nice, opt.Ionice)
 
-	{
+	if opt.Phase != PhaseInstall {
 		args := append(append([]string{}, base...), "-y", "makecache", "--refresh")
 		st, err := runStep(localCtx, "dnf_makecache", cmd, args)
 		steps = append(steps, st)
@@ -31,11 +33,33 @@ func (p *Dnf) Patch(ctx context.Context, opt Options) (*PatchResult, error) {
 		}
 	}
 
+	var names []string
+	if len(opt.IncludePackages) > 0 {
+		var err error
+		if names, err = includedInstalled(localCtx, p, opt); err != nil {
+			res.Steps = steps
+			return res, err
+		}
+		if len(names) == 0 {
+			applyRebootCheck(res)
+			res.Steps = steps
+			return res, nil
+		}
+	}
+
 	{
-		args := []string{"-y", "upgrade", "--refresh"}
+		args := []string{"-y", "upgrade"}
+		// --refresh would expire the metadata the install phase's cache was
+		// filled from.
+		if opt.Phase != PhaseInstall {
+			args = append(args, "--refresh")
+		}
 		if opt.SecurityOnly {
-			args = []string{"-y", "upgrade", "--security", "--refresh"}
+			sec := rpmSecurityArgs(opt)
+			args = append(args, sec...)
+			res.SecurityFilter = strings.Join(sec, " ")
 		}
+		args = append(args, rpmPhaseArgs(opt.Phase)...)
 		if opt.DryRun {
 			args = append(args, "--assumeno")
 		}
@@ -45,14 +69,23 @@ func (p *Dnf) Patch(ctx context.Context, opt Options) (*PatchResult, error) {
 		for _, ex := range opt.ExcludePackages {
 			args = append(args, "--exclude="+ex)
 		}
-		args = append(append([]string{}, base...), args...)
-		st, err := runStep(localCtx, "dnf_upgrade", cmd, args)
+		args = append(append(append([]string{}, base...), args...), names...)
+		// The transaction table is parsed for the dry-run plan, so keep its
+		// headings in English.
+		st, err := runStepWithEnv(localCtx, "dnf_upgrade", cmd, args, append(os.Environ(), "LC_ALL=C"))
+		if err != nil && opt.DryRun && rpmDeclined(st) {
+			st.accept()
+			err = nil
+		}
 		steps = append(steps, st)
 		if err != nil {
 			res.Steps = steps
 			return res, err
 		}
-		res.Patched = true
+		res.Patched = opt.Phase != PhaseDownload
+		if opt.DryRun {
+			res.Plan = rpmPlan(localCtx, st.Result.Stdout)
+		}
 	}
 
 	// reboot required detection: needs-restarting -r (exit 1 => reboot required)
@@ -64,7 +97,7 @@ func (p *Dnf) Patch(ctx context.Context, opt Options) (*PatchResult, error) {
 		if err != nil && r != nil && r.ExitCode == 1 {
 			res.RebootRequired = true
 			res.RebootReason = "needs-restarting indicates reboot required"
-			st.Error = ""
+			st.accept()
 			err = nil
 		}
 		if err != nil {
@@ -73,6 +106,136 @@ func (p *Dnf) Patch(ctx context.Context, opt Options) (*PatchResult, error) {
 		steps = append(steps, st)
 	}
 
+	applyRebootCheck(res)
 	res.Steps = steps
 	return res, nil
 }
+
+func (p *Dnf) ListUpdates(ctx context.Context, opt Options) ([]PendingUpdate, error) {
+	localCtx, cancel := context.WithTimeout(ctx, opt.Timeout)
+	defer cancel()
+
+	cmd, base := prefixWithQoS("dnf", nil, opt.Nice, opt.Ionice)
+	// The install phase lists what the download phase fetched.
+	if opt.Phase == PhaseInstall {
+		return rpmListUpdates(localCtx, cmd, append(base, "-C"))
+	}
+	args := append(append([]string{}, base...), "-y", "makecache", "--refresh")
+	if _, err := executil.Run(localCtx, cmd, args...); err != nil {
+		return nil, err
+	}
+	return rpmListUpdates(localCtx, cmd, base)
+}
+
+func (p *Dnf) Installed(ctx context.Context) ([]InstalledPackage, error) {
+	return installedRPM(ctx)
+}
+
+// InstallVersions relies on `dnf install` with a full NEVRA, which upgrades
+// or downgrades an installed package to exactly that version.
+func (p *Dnf) InstallVersions(ctx context.Context, pkgs []PackageVersion, opt Options) (*PatchResult, error) {
+	info, _ := osinfo.Detect()
+	res := &PatchResult{Backend: p.Name(), OS: info}
+	localCtx, cancel := context.WithTimeout(ctx, opt.Timeout)
+	defer cancel()
+
+	cmd, base := prefixWithQoS("dnf", nil, opt.Nice, opt.Ionice)
+	args := []string{"-y", "install"}
+	if opt.DryRun {
+		args = append(args, "--assumeno")
+	}
+	args = append(append(append([]string{}, base...), args...), rpmSpecs(pkgs)...)
+	st, err := runStep(localCtx, "dnf_install_versions", cmd, args)
+	if err != nil && opt.DryRun && rpmDeclined(st) {
+		st.accept()
+		err = nil
+	}
+	res.Steps = []Step{st}
+	if err != nil {
+		return res, err
+	}
+	res.Patched = true
+
+	applyRebootCheck(res)
+	return res, nil
+}
+
+// Recover removes the older copies of packages an interrupted upgrade left
+// installed next to the new ones. dnf has no complete-transaction tool;
+// the rpm database itself stays consistent, the duplicates are what break
+// later runs.
+func (p *Dnf) Recover(ctx context.Context, opt Options) ([]Step, error) {
+	localCtx, cancel := context.WithTimeout(ctx, opt.Timeout)
+	defer cancel()
+
+	st, err := runStep(localCtx, "dnf_check_duplicates", "dnf", []string{"-q", "repoquery", "--installed", "--duplicates"})
+	steps := []Step{st}
+	if err != nil || strings.TrimSpace(st.Result.Stdout) == "" {
+		return steps, err
+	}
+	st, err = runStep(localCtx, "dnf_remove_duplicates", "dnf", []string{"-y", "remove", "--duplicates"})
+	steps = append(steps, st)
+	return steps, err
+}
+
+// Cleanup removes installonly packages (kernels) beyond the newest
+// c.KeepKernels, which dnf clamps to at least 2 and which never include
+// the running kernel, then autoremoves orphans and cached packages.
+func (p *Dnf) Cleanup(ctx context.Context, opt Options, c CleanupOptions) ([]Step, error) {
+	localCtx, cancel := context.WithTimeout(ctx, opt.Timeout)
+	defer cancel()
+
+	cmd, base := prefixWithQoS("dnf", nil, opt.Nice, opt.Ionice)
+	var steps []Step
+	if c.KeepKernels > 0 {
+		args := append(append([]string{}, base...), "-y", "remove", "--oldinstallonly",
+			"--setopt=installonly_limit="+intToString(max(c.KeepKernels, 2)))
+		st, err := runStep(localCtx, "dnf_remove_old_kernels", cmd, args)
+		if err != nil && st.Result != nil && strings.Contains(st.Result.Stdout+st.Result.Stderr, "No old installonly packages") {
+			st.accept()
+			err = nil
+		}
+		steps = append(steps, st)
+		if err != nil {
+			return steps, err
+		}
+	}
+	for _, s := range []struct {
+		on   bool
+		name string
+		args []string
+	}{
+		{c.Autoremove, "dnf_autoremove", []string{"-y", "autoremove"}},
+		{c.CleanCache, "dnf_clean", []string{"clean", "packages"}},
+	} {
+		if !s.on {
+			continue
+		}
+		st, err := runStep(localCtx, s.name, cmd, append(append([]string{}, base...), s.args...))
+		steps = append(steps, st)
+		if err != nil {
+			return steps, err
+		}
+	}
+	return steps, nil
+}
+
+// Advisories lists the security advisories, installed or available, of the
+// changed packages from updateinfo metadata.
+func (p *Dnf) Advisories(ctx context.Context, changes []PackageChange, opt Options) ([]Advisory, error) {
+	localCtx, cancel := context.WithTimeout(ctx, opt.Timeout)
+	defer cancel()
+
+	base := []string{"-q", "updateinfo", "list", "--all"}
+	return rpmAdvisories(localCtx, "dnf", base, append(append([]string{}, base...), "--with-cve"), changes)
+}
+
+// PublishTimes reads candidate build times from repository metadata.
+func (p *Dnf) PublishTimes(ctx context.Context, ups []PendingUpdate, opt Options) ([]time.Time, error) {
+	localCtx, cancel := context.WithTimeout(ctx, opt.Timeout)
+	defer cancel()
+
+	cmd, base := prefixWithQoS("dnf", nil, opt.Nice, opt.Ionice)
+	args := append(append([]string{}, base...), "-q", "repoquery", "--upgrades", "--qf", rpmBuildTimeFormat)
+	return rpmPublishTimes(localCtx, cmd, args, ups)
+}
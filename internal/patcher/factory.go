@@ -7,24 +7,153 @@ import (
 	"github.com/serverpatcher/serverpatcher/internal/osinfo"
 )
 
-func Select(info *osinfo.Info) (Patcher, error) {
-	if _, ok := executil.LookPathAny("apt-get"); ok {
+// backendOrder is the tie-break order for auto-selection.
+var backendOrder = []string{"apt", "dnf", "yum", "zypper", "pacman", "apk"}
+
+var backendBinaries = map[string]string{
+	"apt":    "apt-get",
+	"dnf":    "dnf",
+	"yum":    "yum",
+	"zypper": "zypper",
+	"pacman": "pacman",
+	"apk":    "apk",
+}
+
+// Candidate is one backend that Select looked at.
+type Candidate struct {
+	Backend string `json:"backend"`
+	Binary  string `json:"binary,omitempty"` // resolved path; empty if not installed
+	OSMatch bool   `json:"os_match"`
+	Score   int    `json:"score"`
+}
+
+type Selection struct {
+	Patcher    Patcher
+	Reason     string
+	Candidates []Candidate
+}
+
+// New returns the backend with the given name.
+func New(name string) (Patcher, error) {
+	switch name {
+	case "apt":
 		return &Apt{}, nil
-	}
-	if _, ok := executil.LookPathAny("dnf"); ok {
+	case "dnf":
 		return &Dnf{}, nil
-	}
-	if _, ok := executil.LookPathAny("yum"); ok {
+	case "yum":
 		return &Yum{}, nil
-	}
-	if _, ok := executil.LookPathAny("zypper"); ok {
+	case "zypper":
 		return &Zypper{}, nil
-	}
-	if _, ok := executil.LookPathAny("pacman"); ok {
+	case "pacman":
 		return &Pacman{}, nil
-	}
-	if _, ok := executil.LookPathAny("apk"); ok {
+	case "apk":
 		return &Apk{}, nil
 	}
-	return nil, fmt.Errorf("no supported package manager detected for %s", info.PrettyName)
+	return nil, fmt.Errorf("unknown backend %q", name)
+}
+
+// SecondarySources are the sources that can run after the distro backend.
+var SecondarySources = []string{"snap", "flatpak", "fwupd"}
+
+var secondaryBinaries = map[string]string{
+	"snap":    "snap",
+	"flatpak": "flatpak",
+	"fwupd":   "fwupdmgr",
+}
+
+// NewSecondary returns the secondary source with the given name, checking
+// that its tool is installed.
+func NewSecondary(name string) (Patcher, error) {
+	var p Patcher
+	switch name {
+	case "snap":
+		p = &Snap{}
+	case "flatpak":
+		p = &Flatpak{}
+	case "fwupd":
+		p = &Fwupd{}
+	default:
+		return nil, fmt.Errorf("unknown secondary source %q", name)
+	}
+	if _, ok := executil.LookPathAny(secondaryBinaries[name]); !ok {
+		return nil, fmt.Errorf("secondary source %q is configured but %s is not installed", name, secondaryBinaries[name])
+	}
+	return p, nil
+}
+
+// Select picks the package-manager backend. An explicit backend ("apt",
+// "dnf", ...) is used as-is once its binary is confirmed; "auto" or ""
+// ranks the installed package managers by how well they fit the OS family
+// in /etc/os-release, so a stray apt-get on Alpine or a dnf on Debian does
+// not win just because it is found first.
+func Select(info *osinfo.Info, backend string) (*Selection, error) {
+	sel := &Selection{}
+	for _, name := range backendOrder {
+		c := Candidate{Backend: name, OSMatch: osMatches(info, name)}
+		if p, ok := executil.LookPathAny(backendBinaries[name]); ok {
+			c.Binary = p
+			c.Score = 1
+			if c.OSMatch {
+				c.Score += 10
+			}
+			// Prefer dnf over yum where both exist; yum is often a dnf alias.
+			if name == "dnf" {
+				c.Score++
+			}
+		}
+		sel.Candidates = append(sel.Candidates, c)
+	}
+
+	if backend != "" && backend != "auto" {
+		p, err := New(backend)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range sel.Candidates {
+			if c.Backend == backend && c.Binary == "" {
+				return nil, fmt.Errorf("backend %q is configured but %s is not installed", backend, backendBinaries[backend])
+			}
+		}
+		sel.Patcher = p
+		sel.Reason = "set by patching.backend"
+		return sel, nil
+	}
+
+	var best *Candidate
+	for i := range sel.Candidates {
+		c := &sel.Candidates[i]
+		if c.Score > 0 && (best == nil || c.Score > best.Score) {
+			best = c
+		}
+	}
+	if best == nil {
+		return nil, fmt.Errorf("no supported package manager detected for %s", info.PrettyName)
+	}
+	p, err := New(best.Backend)
+	if err != nil {
+		return nil, err
+	}
+	sel.Patcher = p
+	if best.OSMatch {
+		sel.Reason = fmt.Sprintf("%s found and matches OS family (ID=%s ID_LIKE=%q)", backendBinaries[best.Backend], info.ID, info.Like)
+	} else {
+		sel.Reason = fmt.Sprintf("%s found; no installed package manager matches OS family (ID=%s ID_LIKE=%q)", backendBinaries[best.Backend], info.ID, info.Like)
+	}
+	return sel, nil
+}
+
+func osMatches(info *osinfo.Info, backend string) bool {
+	switch backend {
+	case "apt":
+		return info.IsDebianLike()
+	case "dnf", "yum":
+		return info.IsRHELLike()
+	case "zypper":
+		return info.IsSUSELike()
+	case "pacman":
+		return info.IsArchLinux()
+	case "apk":
+		return info.IsAlpine()
+	}
+	return false
 }
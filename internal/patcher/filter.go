@@ -0,0 +1,104 @@
+package patcher
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+)
+
+// matchAny reports whether name matches any of the shell-style patterns.
+func matchAny(name string, patterns []string) bool {
+	for _, pat := range patterns {
+		if ok, _ := path.Match(pat, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// expandPatterns returns the sorted, de-duplicated names of installed
+// packages that match any of the patterns.
+func expandPatterns(pkgs []InstalledPackage, patterns []string) []string {
+	seen := map[string]bool{}
+	var names []string
+	for _, p := range pkgs {
+		if seen[p.Name] || !matchAny(p.Name, patterns) {
+			continue
+		}
+		seen[p.Name] = true
+		names = append(names, p.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// kernelPatterns are the kernel packages each backend leaves alone when
+// kernel updates are disallowed.
+var kernelPatterns = map[string][]string{
+	"apt":    aptKernelPatterns,
+	"dnf":    {"kernel*"},
+	"yum":    {"kernel*"},
+	"zypper": {"kernel*"},
+	"pacman": pacmanKernelPackages,
+	"apk":    apkKernelPatterns,
+}
+
+func excludePatterns(backend string, opt Options) []string {
+	exclude := append([]string{}, opt.ExcludePackages...)
+	if !opt.AllowKernel {
+		exclude = append(exclude, kernelPatterns[backend]...)
+	}
+	return exclude
+}
+
+// FilterUpdates drops the pending updates that a run of backend with opt
+// would not install: packages outside include_packages, excluded packages,
+// kernels when disallowed and, with security_only, updates not marked as
+// security fixes.
+func FilterUpdates(backend string, ups []PendingUpdate, opt Options) []PendingUpdate {
+	exclude := excludePatterns(backend, opt)
+	var out []PendingUpdate
+	for _, u := range ups {
+		if matchAny(u.Name, exclude) || (opt.SecurityOnly && !u.Security) {
+			continue
+		}
+		if len(opt.IncludePackages) > 0 && !matchAny(u.Name, opt.IncludePackages) {
+			continue
+		}
+		out = append(out, u)
+	}
+	return out
+}
+
+// noInclude lists the backends that cannot upgrade single packages, and why.
+var noInclude = map[string]string{
+	"pacman": "Arch does not support partial upgrades",
+}
+
+// CheckInclude returns an error if backend cannot restrict a run to the
+// packages in include.
+func CheckInclude(backend string, include []string) error {
+	if why, ok := noInclude[backend]; ok && len(include) > 0 {
+		return fmt.Errorf("include_packages is not supported on %s: %s", backend, why)
+	}
+	return nil
+}
+
+// includedInstalled resolves opt.IncludePackages to installed package
+// names, leaving out the ones the run must not touch. Excludes win over
+// includes.
+func includedInstalled(ctx context.Context, p Patcher, opt Options) ([]string, error) {
+	pkgs, err := p.Installed(ctx)
+	if err != nil {
+		return nil, err
+	}
+	exclude := excludePatterns(p.Name(), opt)
+	var names []string
+	for _, n := range expandPatterns(pkgs, opt.IncludePackages) {
+		if !matchAny(n, exclude) {
+			names = append(names, n)
+		}
+	}
+	return names, nil
+}
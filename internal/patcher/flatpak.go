@@ -0,0 +1,116 @@
+package patcher
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/serverpatcher/serverpatcher/internal/executil"
+	"github.com/serverpatcher/serverpatcher/internal/osinfo"
+)
+
+// Flatpak is a secondary source covering system-wide installations.
+type Flatpak struct{}
+
+func (p *Flatpak) Name() string { return "flatpak" }
+
+func (p *Flatpak) Patch(ctx context.Context, opt Options) (*PatchResult, error) {
+	info, _ := osinfo.Detect()
+	res := &PatchResult{Backend: p.Name(), OS: info}
+	localCtx, cancel := context.WithTimeout(ctx, opt.Timeout)
+	defer cancel()
+
+	if opt.SecurityOnly {
+		return res, fmt.Errorf("security_only is not supported for flatpaks: remotes publish no security metadata")
+	}
+
+	steps := []Step{}
+	cmd, base := prefixWithQoS("flatpak", nil, opt.Nice, opt.Ionice)
+
+	var selected []string
+	if opt.DryRun || len(opt.ExcludePackages) > 0 {
+		st, err := runStep(localCtx, "flatpak_remote_ls_updates", "flatpak", flatpakUpdatesArgs)
+		steps = append(steps, st)
+		if err != nil {
+			res.Steps = steps
+			return res, err
+		}
+		for _, u := range parseFlatpakColumns(st.Result.Stdout) {
+			app, _, _ := strings.Cut(u.Name, "//")
+			if !matchAny(app, opt.ExcludePackages) {
+				selected = append(selected, app)
+			}
+		}
+		if opt.DryRun || len(selected) == 0 {
+			res.Patched = opt.DryRun
+			res.Steps = steps
+			return res, nil
+		}
+	}
+
+	args := append(append(append([]string{}, base...), "update", "--noninteractive", "-y"), selected...)
+	st, err := runStep(localCtx, "flatpak_update", cmd, args)
+	steps = append(steps, st)
+	if err != nil {
+		res.Steps = steps
+		return res, err
+	}
+	res.Patched = true
+
+	res.Steps = steps
+	return res, nil
+}
+
+var flatpakUpdatesArgs = []string{"remote-ls", "--updates", "--columns=application,arch,branch,version,commit"}
+
+func (p *Flatpak) ListUpdates(ctx context.Context, opt Options) ([]PendingUpdate, error) {
+	localCtx, cancel := context.WithTimeout(ctx, opt.Timeout)
+	defer cancel()
+
+	r, err := executil.Run(localCtx, "flatpak", flatpakUpdatesArgs...)
+	if err != nil {
+		return nil, err
+	}
+	cur := map[string]string{}
+	if installed, err := p.Installed(localCtx); err == nil {
+		for _, i := range installed {
+			cur[i.Name+"/"+i.Arch] = i.Version
+		}
+	}
+	ups := []PendingUpdate{}
+	for _, u := range parseFlatpakColumns(r.Stdout) {
+		ups = append(ups, PendingUpdate{Name: u.Name, Arch: u.Arch, Current: cur[u.Name+"/"+u.Arch], Candidate: u.Version})
+	}
+	return ups, nil
+}
+
+func (p *Flatpak) Installed(ctx context.Context) ([]InstalledPackage, error) {
+	r, err := executil.Run(ctx, "flatpak", "list", "--system", "--columns=application,arch,branch,version,active")
+	if err != nil {
+		return nil, err
+	}
+	return parseFlatpakColumns(r.Stdout), nil
+}
+
+// parseFlatpakColumns parses tab-separated application, arch, branch,
+// version and commit columns. Names are "app//branch" because runtimes are
+// often installed in several branches at once; the commit is part of the
+// version because many refs carry no version string at all.
+func parseFlatpakColumns(out string) []InstalledPackage {
+	var pkgs []InstalledPackage
+	for _, line := range strings.Split(out, "\n") {
+		f := strings.Split(line, "\t")
+		if len(f) != 5 || f[0] == "Application ID" {
+			continue
+		}
+		for i := range f {
+			f[i] = strings.TrimSpace(f[i])
+		}
+		version := f[4]
+		if f[3] != "" {
+			version = f[3] + " (" + f[4] + ")"
+		}
+		pkgs = append(pkgs, InstalledPackage{Name: f[0] + "//" + f[2], Arch: f[1], Version: version})
+	}
+	return pkgs
+}
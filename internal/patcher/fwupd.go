@@ -0,0 +1,199 @@
+package patcher
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	"github.com/serverpatcher/serverpatcher/internal/executil"
+	"github.com/serverpatcher/serverpatcher/internal/osinfo"
+)
+
+// fwupdmgr exits with 2 when there is nothing to do (metadata current, no
+// updates available).
+const fwupdExitNothingToDo = 2
+
+// Fwupd is a secondary source that updates device firmware through fwupd.
+// Packages in its results are devices and versions are firmware versions.
+type Fwupd struct{}
+
+func (p *Fwupd) Name() string { return "fwupd" }
+
+type fwupdDevice struct {
+	Name     string         `json:"Name"`
+	DeviceID string         `json:"DeviceId"`
+	Version  string         `json:"Version"`
+	Flags    []string       `json:"Flags"`
+	Releases []fwupdRelease `json:"Releases"`
+}
+
+type fwupdRelease struct {
+	Version string   `json:"Version"`
+	Issues  []string `json:"Issues"`
+}
+
+type fwupdDevices struct {
+	Devices []fwupdDevice `json:"Devices"`
+}
+
+func (p *Fwupd) Patch(ctx context.Context, opt Options) (*PatchResult, error) {
+	info, _ := osinfo.Detect()
+	res := &PatchResult{Backend: p.Name(), OS: info}
+	localCtx, cancel := context.WithTimeout(ctx, opt.Timeout)
+	defer cancel()
+
+	steps := []Step{}
+	cmd, base := prefixWithQoS("fwupdmgr", nil, opt.Nice, opt.Ionice)
+
+	{
+		args := append(append([]string{}, base...), "refresh", "--force")
+		st, err := runFwupdStep(localCtx, "fwupd_refresh", cmd, args)
+		steps = append(steps, st)
+		if err != nil {
+			res.Steps = steps
+			return res, err
+		}
+	}
+
+	var selected []fwupdDevice
+	{
+		st, err := runFwupdStep(localCtx, "fwupd_get_updates", "fwupdmgr", []string{"get-updates", "--json"})
+		steps = append(steps, st)
+		if err != nil {
+			res.Steps = steps
+			return res, err
+		}
+		for _, d := range parseFwupdDevices(st.Result.Stdout) {
+			if len(d.Releases) == 0 || matchAny(d.Name, opt.ExcludePackages) {
+				continue
+			}
+			// Only releases that list CVEs count as security fixes.
+			if opt.SecurityOnly && len(d.Releases[0].Issues) == 0 {
+				continue
+			}
+			selected = append(selected, d)
+		}
+	}
+
+	if opt.DryRun {
+		for _, d := range selected {
+			res.Plan = append(res.Plan, PackageChange{
+				Name:       d.Name,
+				OldVersion: d.Version,
+				NewVersion: d.Releases[0].Version,
+				Action:     ChangeUpgraded,
+			})
+		}
+	}
+	if opt.DryRun || len(selected) == 0 {
+		res.Patched = opt.DryRun
+		res.Steps = steps
+		return res, nil
+	}
+
+	// Update device by device so excludes and security_only are honoured;
+	// one failing device does not keep the others from updating.
+	var firstErr error
+	for _, d := range selected {
+		args := append(append([]string{}, base...), "update", d.DeviceID, "--assume-yes", "--no-reboot-check")
+		st, err := runFwupdStep(localCtx, "fwupd_update", cmd, args)
+		steps = append(steps, st)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		res.Changes = append(res.Changes, PackageChange{
+			Name:       d.Name,
+			OldVersion: d.Version,
+			NewVersion: d.Releases[0].Version,
+			Action:     ChangeUpgraded,
+		})
+	}
+	if firstErr != nil {
+		res.Steps = steps
+		return res, firstErr
+	}
+	res.Patched = true
+
+	// Most firmware is staged and only flashed on the next boot.
+	if r, err := executil.Run(localCtx, "fwupdmgr", "get-devices", "--json"); err == nil {
+		var pending []string
+		for _, d := range parseFwupdDevices(r.Stdout) {
+			if containsString(d.Flags, "needs-reboot") || containsString(d.Flags, "needs-shutdown") {
+				pending = append(pending, d.Name)
+			}
+		}
+		if len(pending) > 0 {
+			res.RebootRequired = true
+			res.RebootReason = "firmware update pending for: " + strings.Join(pending, ", ")
+		}
+	}
+
+	res.Steps = steps
+	return res, nil
+}
+
+func (p *Fwupd) ListUpdates(ctx context.Context, opt Options) ([]PendingUpdate, error) {
+	localCtx, cancel := context.WithTimeout(ctx, opt.Timeout)
+	defer cancel()
+
+	r, err := executil.Run(localCtx, "fwupdmgr", "get-updates", "--json")
+	if err != nil && (r == nil || r.ExitCode != fwupdExitNothingToDo) {
+		return nil, err
+	}
+	ups := []PendingUpdate{}
+	for _, d := range parseFwupdDevices(r.Stdout) {
+		if len(d.Releases) == 0 {
+			continue
+		}
+		ups = append(ups, PendingUpdate{
+			Name:      d.Name,
+			Current:   d.Version,
+			Candidate: d.Releases[0].Version,
+			Security:  len(d.Releases[0].Issues) > 0,
+		})
+	}
+	return ups, nil
+}
+
+func (p *Fwupd) Installed(ctx context.Context) ([]InstalledPackage, error) {
+	r, err := executil.Run(ctx, "fwupdmgr", "get-devices", "--json")
+	if err != nil {
+		return nil, err
+	}
+	var pkgs []InstalledPackage
+	for _, d := range parseFwupdDevices(r.Stdout) {
+		if d.Version != "" {
+			pkgs = append(pkgs, InstalledPackage{Name: d.Name, Version: d.Version})
+		}
+	}
+	return pkgs, nil
+}
+
+func runFwupdStep(ctx context.Context, name, cmd string, args []string) (Step, error) {
+	st, err := runStep(ctx, name, cmd, args)
+	if err != nil && st.Result != nil && st.Result.ExitCode == fwupdExitNothingToDo {
+		st.accept()
+		return st, nil
+	}
+	return st, err
+}
+
+func parseFwupdDevices(out string) []fwupdDevice {
+	var d fwupdDevices
+	if err := json.Unmarshal([]byte(out), &d); err != nil {
+		return nil
+	}
+	return d.Devices
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,181 @@
+package patcher
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/serverpatcher/serverpatcher/internal/executil"
+)
+
+// InstalledPackage is one entry of the host's package database. Arch is
+// empty on backends that do not report it.
+type InstalledPackage struct {
+	Name    string `json:"name"`
+	Arch    string `json:"arch,omitempty"`
+	Version string `json:"version"`
+}
+
+type ChangeAction string
+
+const (
+	ChangeUpgraded  ChangeAction = "upgraded"
+	ChangeInstalled ChangeAction = "installed"
+	ChangeRemoved   ChangeAction = "removed"
+)
+
+type PackageChange struct {
+	Name       string       `json:"name"`
+	Arch       string       `json:"arch,omitempty"`
+	OldVersion string       `json:"old_version,omitempty"`
+	NewVersion string       `json:"new_version,omitempty"`
+	Action     ChangeAction `json:"action"`
+	// Set from AdvisoryLister data: the advisories and CVEs the change
+	// fixes and the highest advisory severity.
+	Advisories []string `json:"advisories,omitempty"`
+	CVEs       []string `json:"cves,omitempty"`
+	Severity   string   `json:"severity,omitempty"`
+}
+
+// DiffInstalled compares two package snapshots. Packages that can be
+// installed in several versions at once (kernels) show up as "installed"
+// when a version is added alongside the existing ones.
+func DiffInstalled(before, after []InstalledPackage) []PackageChange {
+	type key struct{ name, arch string }
+	group := func(pkgs []InstalledPackage) map[key][]string {
+		m := map[key][]string{}
+		for _, p := range pkgs {
+			k := key{p.Name, p.Arch}
+			m[k] = append(m[k], p.Version)
+		}
+		return m
+	}
+	b, a := group(before), group(after)
+
+	keys := []key{}
+	for k := range b {
+		keys = append(keys, k)
+	}
+	for k := range a {
+		if _, ok := b[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].name != keys[j].name {
+			return keys[i].name < keys[j].name
+		}
+		return keys[i].arch < keys[j].arch
+	})
+
+	var changes []PackageChange
+	for _, k := range keys {
+		gone := subtract(b[k], a[k])
+		added := subtract(a[k], b[k])
+		c := PackageChange{
+			Name:       k.name,
+			Arch:       k.arch,
+			OldVersion: strings.Join(gone, ", "),
+			NewVersion: strings.Join(added, ", "),
+		}
+		switch {
+		case len(gone) == 0 && len(added) == 0:
+			continue
+		case len(gone) == 0:
+			c.Action = ChangeInstalled
+		case len(added) == 0:
+			c.Action = ChangeRemoved
+		default:
+			c.Action = ChangeUpgraded
+		}
+		changes = append(changes, c)
+	}
+	return changes
+}
+
+func subtract(a, b []string) []string {
+	var out []string
+	for _, v := range a {
+		found := false
+		for _, w := range b {
+			if v == w {
+				found = true
+				break
+			}
+		}
+		if !found {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// installedDpkg lists packages that dpkg considers present, including
+// half-configured ones, but not packages with only config files left.
+func installedDpkg(ctx context.Context) ([]InstalledPackage, error) {
+	r, err := executil.Run(ctx, "dpkg-query", "-W", "-f", "${db:Status-Abbrev}\t${Package}\t${Architecture}\t${Version}\n")
+	if err != nil {
+		return nil, err
+	}
+	var pkgs []InstalledPackage
+	for _, line := range strings.Split(r.Stdout, "\n") {
+		f := strings.Split(line, "\t")
+		if len(f) != 4 || len(f[0]) < 2 || f[0][1] == 'n' || f[0][1] == 'c' {
+			continue
+		}
+		pkgs = append(pkgs, InstalledPackage{Name: f[1], Arch: f[2], Version: f[3]})
+	}
+	return pkgs, nil
+}
+
+func installedRPM(ctx context.Context) ([]InstalledPackage, error) {
+	r, err := executil.Run(ctx, "rpm", "-qa", "--qf", "%{NAME}\t%{ARCH}\t%{EPOCH}:%{VERSION}-%{RELEASE}\n")
+	if err != nil {
+		return nil, err
+	}
+	var pkgs []InstalledPackage
+	for _, line := range strings.Split(r.Stdout, "\n") {
+		f := strings.Split(line, "\t")
+		if len(f) != 3 {
+			continue
+		}
+		arch := f[1]
+		if arch == "(none)" {
+			arch = ""
+		}
+		pkgs = append(pkgs, InstalledPackage{Name: f[0], Arch: arch, Version: rpmTrimEpoch(f[2])})
+	}
+	return pkgs, nil
+}
+
+func installedPacman(ctx context.Context) ([]InstalledPackage, error) {
+	r, err := executil.Run(ctx, "pacman", "-Q")
+	if err != nil {
+		return nil, err
+	}
+	var pkgs []InstalledPackage
+	for _, line := range strings.Split(r.Stdout, "\n") {
+		f := strings.Fields(line)
+		if len(f) != 2 {
+			continue
+		}
+		pkgs = append(pkgs, InstalledPackage{Name: f[0], Version: f[1]})
+	}
+	return pkgs, nil
+}
+
+func installedApk(ctx context.Context) ([]InstalledPackage, error) {
+	r, err := executil.Run(ctx, "apk", "info", "-v")
+	if err != nil {
+		return nil, err
+	}
+	var pkgs []InstalledPackage
+	for _, line := range strings.Split(r.Stdout, "\n") {
+		name, ver, ok := splitApkNameVersion(strings.TrimSpace(line))
+		if !ok {
+			continue
+		}
+		pkgs = append(pkgs, InstalledPackage{Name: name, Version: ver})
+	}
+	return pkgs, nil
+}
@@ -0,0 +1,41 @@
+package patcher
+
+import "github.com/serverpatcher/serverpatcher/internal/lock"
+
+// lockFiles are the locks each backend's package manager takes. Several
+// tools share them: the rpm database lock blocks dnf, yum, zypper and
+// PackageKit alike.
+var lockFiles = map[string][]lock.File{
+	"apt": {
+		{Path: "/var/lib/dpkg/lock-frontend", Kind: lock.Held},
+		{Path: "/var/lib/dpkg/lock", Kind: lock.Held},
+		{Path: "/var/lib/apt/lists/lock", Kind: lock.Held},
+		{Path: "/var/cache/apt/archives/lock", Kind: lock.Held},
+	},
+	"dnf": {
+		{Path: "/var/lib/rpm/.rpm.lock", Kind: lock.Held},
+		{Path: "/var/lib/dnf/rpmdb_lock.pid", Kind: lock.PIDFile},
+		{Path: "/var/cache/dnf/metadata_lock.pid", Kind: lock.PIDFile},
+		{Path: "/var/cache/dnf/download_lock.pid", Kind: lock.PIDFile},
+	},
+	"yum": {
+		{Path: "/var/lib/rpm/.rpm.lock", Kind: lock.Held},
+		{Path: "/var/run/yum.pid", Kind: lock.PIDFile},
+	},
+	"zypper": {
+		{Path: "/var/lib/rpm/.rpm.lock", Kind: lock.Held},
+		{Path: "/run/zypp.pid", Kind: lock.PIDFile},
+	},
+	"pacman": {
+		{Path: "/var/lib/pacman/db.lck", Kind: lock.Exists},
+	},
+	"apk": {
+		{Path: "/lib/apk/db/lock", Kind: lock.Held},
+	},
+}
+
+// LockHolders reports which processes hold the package manager locks of
+// backend. Backends without known lock files never report holders.
+func LockHolders(backend string) []lock.Holder {
+	return lock.Holders(lockFiles[backend])
+}
@@ -2,8 +2,15 @@ package patcher
 
 import (
 	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
+	"github.com/serverpatcher/serverpatcher/internal/executil"
 	"github.com/serverpatcher/serverpatcher/internal/osinfo"
+	"github.com/serverpatcher/serverpatcher/internal/pkgver"
 )
 
 type Pacman struct{}
@@ -16,12 +23,51 @@ func (p *Pacman) Patch(ctx context.Context, opt Options) (*PatchResult, error) {
 	localCtx, cancel := context.WithTimeout(ctx, opt.Timeout)
 	defer cancel()
 
-	steps := []Step{}
 	cmd, base := prefixWithQoS("pacman", nil, opt.Nice, opt.Ionice)
 
+	ignore := append([]string{}, opt.ExcludePackages...)
+	if !opt.AllowKernel {
+		ignore = append(ignore, pacmanKernelPackages...)
+	}
+
+	if err := CheckInclude(p.Name(), opt.IncludePackages); err != nil {
+		return res, err
+	}
+	steps := []Step{}
+	if opt.SecurityOnly {
+		pending, st, err := p.securityPending(localCtx, opt, ignore)
+		steps = append(steps, st...)
+		res.SecurityFilter = "arch-audit, full upgrade when a fix is pending"
+		if opt.MinSeverity != "" {
+			res.SecurityFilter = "arch-audit severity " + opt.MinSeverity + " or higher, full upgrade when a fix is pending"
+		}
+		if err != nil {
+			res.Steps = steps
+			return res, err
+		}
+		if !pending {
+			applyRebootCheck(res)
+			res.Steps = steps
+			return res, nil
+		}
+	}
+
 	args := []string{"-Syu", "--noconfirm"}
-	if opt.DryRun {
-		args = []string{"-Syu", "--noconfirm", "--print"}
+	switch {
+	case opt.DryRun:
+		args = []string{"-Syu", "--noconfirm", "--print", "--print-format", pacmanPrintFormat}
+	case opt.Phase == PhaseDownload:
+		args = []string{"-Syuw", "--noconfirm"}
+	case opt.Phase == PhaseInstall:
+		// No -y: upgrade to what the download phase synced and fetched.
+		args = []string{"-Su", "--noconfirm"}
+	}
+	if len(ignore) > 0 {
+		args = append(args, "--ignore", strings.Join(ignore, ","))
+	}
+	// An exclude entry may name a group; unknown group names are harmless.
+	if len(opt.ExcludePackages) > 0 {
+		args = append(args, "--ignoregroup", strings.Join(opt.ExcludePackages, ","))
 	}
 	args = append(append([]string{}, base...), args...)
 	st, err := runStep(localCtx, "pacman_Syu", cmd, args)
@@ -30,8 +76,314 @@ func (p *Pacman) Patch(ctx context.Context, opt Options) (*PatchResult, error) {
 		res.Steps = steps
 		return res, err
 	}
+	res.Patched = opt.Phase != PhaseDownload
+	if opt.DryRun {
+		res.Plan = pacmanPlan(localCtx, st.Result.Stdout)
+	}
+
+	applyRebootCheck(res)
+	res.Steps = steps
+	return res, nil
+}
+
+// pacmanKernelPackages are the kernels shipped in the official repositories
+// and their headers.
+var pacmanKernelPackages = []string{
+	"linux", "linux-headers",
+	"linux-lts", "linux-lts-headers",
+	"linux-zen", "linux-zen-headers",
+	"linux-hardened", "linux-hardened-headers",
+	"linux-rt", "linux-rt-headers",
+	"linux-rt-lts", "linux-rt-lts-headers",
+}
+
+// securityPending reports whether a pending update fixes an arch-audit
+// issue (of at least opt.MinSeverity). Arch does not support partial
+// upgrades, so a security run is a full upgrade that only happens when
+// this is true; the pending updates come from ListUpdates, which does not
+// sync the system database.
+func (p *Pacman) securityPending(ctx context.Context, opt Options, ignore []string) (bool, []Step, error) {
+	if _, ok := executil.LookPathAny("arch-audit"); !ok {
+		return false, nil, fmt.Errorf("security_only on pacman requires arch-audit, which is not installed")
+	}
+	ups, err := p.ListUpdates(ctx, opt)
+	if err != nil {
+		return false, nil, err
+	}
+	candidate := map[string]string{}
+	for _, u := range ups {
+		candidate[u.Name] = u.Candidate
+	}
+
+	st, err := runStep(ctx, "pacman_arch_audit", "arch-audit", []string{"--format", "%n %s %v"})
+	if err != nil {
+		return false, []Step{st}, err
+	}
+	// Lines are "name severity fixed-version"; the fixed version is
+	// missing while an issue has no fix. arch-audit rates issues Low,
+	// Medium, High or Critical.
+	for _, line := range strings.Split(st.Result.Stdout, "\n") {
+		f := strings.Fields(line)
+		if len(f) < 3 || matchAny(f[0], ignore) {
+			continue
+		}
+		if opt.MinSeverity != "" && !SeverityAtLeast(NormalizeSeverity(f[1]), opt.MinSeverity) {
+			continue
+		}
+		if cand, ok := candidate[f[0]]; ok && pkgver.Compare(cand, f[2]) >= 0 {
+			return true, []Step{st}, nil
+		}
+	}
+	return false, []Step{st}, nil
+}
+
+// pacmanPrintFormat makes --print list "name version" instead of download URLs.
+const pacmanPrintFormat = "%n %v"
+
+// pacmanPlan turns --print output into a plan. pacman prints only the
+// target version, so the installed one comes from the local database;
+// packages not installed yet are new dependencies.
+func pacmanPlan(ctx context.Context, out string) []PackageChange {
+	installed := map[string]string{}
+	if pkgs, err := installedPacman(ctx); err == nil {
+		for _, p := range pkgs {
+			installed[p.Name] = p.Version
+		}
+	}
+	var plan []PackageChange
+	for _, line := range strings.Split(out, "\n") {
+		f := strings.Fields(line)
+		if len(f) != 2 {
+			continue
+		}
+		c := PackageChange{Name: f[0], NewVersion: f[1], Action: ChangeInstalled}
+		if cur, ok := installed[f[0]]; ok {
+			c.OldVersion = cur
+			c.Action = ChangeUpgraded
+		}
+		plan = append(plan, c)
+	}
+	return plan
+}
+
+func (p *Pacman) ListUpdates(ctx context.Context, opt Options) ([]PendingUpdate, error) {
+	localCtx, cancel := context.WithTimeout(ctx, opt.Timeout)
+	defer cancel()
+
+	// checkupdates (pacman-contrib) syncs into a temporary database, which
+	// avoids the partial-upgrade hazard of running `pacman -Sy` on its own.
+	// Without it we can only compare against the last synced database.
+	name, args, noneExit := "pacman", []string{"-Qu"}, 1
+	if _, ok := executil.LookPathAny("checkupdates"); ok {
+		name, args, noneExit = "checkupdates", nil, 2
+	}
+	r, err := executil.Run(localCtx, name, args...)
+	if err != nil {
+		if r != nil && r.ExitCode == noneExit && r.Stdout == "" {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return parsePacmanUpdates(r.Stdout), nil
+}
+
+// parsePacmanUpdates parses "name old -> new" lines from pacman -Qu and checkupdates.
+func parsePacmanUpdates(out string) []PendingUpdate {
+	var ups []PendingUpdate
+	for _, line := range strings.Split(out, "\n") {
+		f := strings.Fields(line)
+		if len(f) < 4 || f[2] != "->" {
+			continue
+		}
+		ups = append(ups, PendingUpdate{Name: f[0], Current: f[1], Candidate: f[3]})
+	}
+	return ups
+}
+
+func (p *Pacman) Installed(ctx context.Context) ([]InstalledPackage, error) {
+	return installedPacman(ctx)
+}
+
+var pacmanCacheDir = "/var/cache/pacman/pkg"
+
+// InstallVersions installs package files from the pacman cache, since the
+// sync database only ever offers one version per package. A version that
+// is not cached can still be installed when it is the current sync version.
+func (p *Pacman) InstallVersions(ctx context.Context, pkgs []PackageVersion, opt Options) (*PatchResult, error) {
+	info, _ := osinfo.Detect()
+	res := &PatchResult{Backend: p.Name(), OS: info}
+	localCtx, cancel := context.WithTimeout(ctx, opt.Timeout)
+	defer cancel()
+
+	var files, syncNames, missing []string
+	for _, pv := range pkgs {
+		if f := pacmanCachedFile(pv.Name, pv.Version); f != "" {
+			files = append(files, f)
+			continue
+		}
+		r, err := executil.Run(localCtx, "pacman", "-Sp", "--print-format", "%v", pv.Name)
+		if err == nil && strings.TrimSpace(r.Stdout) == pv.Version {
+			syncNames = append(syncNames, pv.Name)
+			continue
+		}
+		missing = append(missing, pv.Name+"="+pv.Version)
+	}
+	if len(missing) > 0 {
+		return res, fmt.Errorf("versions not in %s or the sync database: %s", pacmanCacheDir, strings.Join(missing, ", "))
+	}
+
+	steps := []Step{}
+	cmd, base := prefixWithQoS("pacman", nil, opt.Nice, opt.Ionice)
+	for _, group := range []struct {
+		name string
+		args []string
+	}{{"pacman_U_versions", append([]string{"-U"}, files...)}, {"pacman_S_versions", append([]string{"-S"}, syncNames...)}} {
+		if len(group.args) == 1 {
+			continue
+		}
+		args := append(append([]string{}, base...), group.args...)
+		args = append(args, "--noconfirm")
+		if opt.DryRun {
+			args = append(args, "--print")
+		}
+		st, err := runStep(localCtx, group.name, cmd, args)
+		steps = append(steps, st)
+		if err != nil {
+			res.Steps = steps
+			return res, err
+		}
+	}
 	res.Patched = true
 
+	applyRebootCheck(res)
 	res.Steps = steps
 	return res, nil
 }
+
+// pacmanCachedFile finds name-version-arch.pkg.tar.* in the package cache.
+func pacmanCachedFile(name, version string) string {
+	matches, _ := filepath.Glob(filepath.Join(pacmanCacheDir, name+"-"+version+"-*.pkg.tar.*"))
+	for _, m := range matches {
+		if strings.HasSuffix(m, ".sig") {
+			continue
+		}
+		// Guard against name-version prefixes of other packages, e.g.
+		// "foo-1.0-1" matching "foo-1.0-10".
+		rest := strings.TrimPrefix(filepath.Base(m), name+"-"+version+"-")
+		if !strings.Contains(strings.SplitN(rest, ".pkg.tar.", 2)[0], "-") {
+			return m
+		}
+	}
+	return ""
+}
+
+// Recover removes a db.lck that no running process holds. pacman leaves it
+// behind when killed and refuses to run until it is gone.
+func (p *Pacman) Recover(ctx context.Context, opt Options) ([]Step, error) {
+	var steps []Step
+	for _, h := range LockHolders(p.Name()) {
+		if !h.Stale {
+			continue
+		}
+		st := Step{Name: "pacman_remove_stale_lock", Started: time.Now()}
+		err := os.Remove(h.Path)
+		st.Ended = time.Now()
+		if err != nil && !os.IsNotExist(err) {
+			st.Error = err.Error()
+			steps = append(steps, st)
+			return steps, fmt.Errorf("remove stale pacman lock %s: %w", h.Path, err)
+		}
+		steps = append(steps, st)
+	}
+	return steps, nil
+}
+
+// Cleanup removes orphaned dependencies and cached packages of versions no
+// longer installed. pacman keeps one version of each kernel package, so
+// there are no old kernels to remove.
+func (p *Pacman) Cleanup(ctx context.Context, opt Options, c CleanupOptions) ([]Step, error) {
+	localCtx, cancel := context.WithTimeout(ctx, opt.Timeout)
+	defer cancel()
+
+	cmd, base := prefixWithQoS("pacman", nil, opt.Nice, opt.Ionice)
+	var steps []Step
+	if c.Autoremove {
+		// -Qdtq exits 1 when there are no orphans.
+		r, err := executil.Run(localCtx, "pacman", "-Qdtq")
+		if err != nil && (r == nil || r.ExitCode != 1) {
+			return steps, err
+		}
+		if orphans := strings.Fields(r.Stdout); len(orphans) > 0 {
+			args := append(append(append([]string{}, base...), "-Rns", "--noconfirm"), orphans...)
+			st, err := runStep(localCtx, "pacman_remove_orphans", cmd, args)
+			steps = append(steps, st)
+			if err != nil {
+				return steps, err
+			}
+		}
+	}
+	if c.CleanCache {
+		cacheCmd, args := cmd, append(append([]string{}, base...), "-Sc", "--noconfirm")
+		if _, ok := executil.LookPathAny("paccache"); ok {
+			cacheCmd, args = prefixWithQoS("paccache", []string{"-r", "-k", "1"}, opt.Nice, opt.Ionice)
+		}
+		st, err := runStep(localCtx, "pacman_clean_cache", cacheCmd, args)
+		steps = append(steps, st)
+		if err != nil {
+			return steps, err
+		}
+	}
+	return steps, nil
+}
+
+// PublishTimes reads build dates from the sync database. checkupdates may
+// have found a newer version than the database holds; those stay unknown.
+func (p *Pacman) PublishTimes(ctx context.Context, ups []PendingUpdate, opt Options) ([]time.Time, error) {
+	localCtx, cancel := context.WithTimeout(ctx, opt.Timeout)
+	defer cancel()
+
+	names := make([]string, 0, len(ups))
+	for _, u := range ups {
+		names = append(names, u.Name)
+	}
+	// pacman exits non-zero if any name is missing; use what it printed.
+	r, _ := runCommandWithEnv(localCtx, "pacman", append([]string{"-Si"}, names...), append(os.Environ(), "LC_ALL=C"))
+	if r == nil {
+		return nil, fmt.Errorf("pacman -Si failed")
+	}
+	built := parsePacmanBuildDates(r.Stdout)
+	out := make([]time.Time, len(ups))
+	for i, u := range ups {
+		out[i] = built[u.Name+" "+u.Candidate]
+	}
+	return out, nil
+}
+
+// parsePacmanBuildDates returns the "Build Date" of each `pacman -Si`
+// record keyed by "name version". The first repository listing a package
+// wins, as it does for pacman.
+func parsePacmanBuildDates(out string) map[string]time.Time {
+	built := map[string]time.Time{}
+	var name, version string
+	for _, line := range strings.Split(out, "\n") {
+		if strings.TrimSpace(line) == "" {
+			name, version = "", ""
+			continue
+		}
+		k, v, _ := strings.Cut(line, ":")
+		v = strings.TrimSpace(v)
+		switch strings.TrimSpace(k) {
+		case "Name":
+			name = v
+		case "Version":
+			version = v
+		case "Build Date":
+			t, err := time.ParseInLocation("Mon Jan _2 15:04:05 2006", v, time.Local)
+			key := name + " " + version
+			if _, seen := built[key]; err == nil && name != "" && !seen {
+				built[key] = t
+			}
+		}
+	}
+	return built
+}
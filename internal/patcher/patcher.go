@@ -9,33 +9,96 @@ import (
 )
 
 type Step struct {
-	Name    string           `json:"name"`
-	Started time.Time        `json:"started"`
-	Ended   time.Time        `json:"ended"`
-	Result  *executil.Result `json:"result,omitempty"`
-	Error   string           `json:"error,omitempty"`
+	Name     string           `json:"name"`
+	Started  time.Time        `json:"started"`
+	Ended    time.Time        `json:"ended"`
+	Result   *executil.Result `json:"result,omitempty"`
+	Error    string           `json:"error,omitempty"`
+	Category Category         `json:"category,omitempty"` // failed steps only
+	Attempts int              `json:"attempts,omitempty"` // set when retried
 }
 
 type PatchResult struct {
 	Backend        string       `json:"backend"`
-	OS             *osinfo.Info  `json:"os"`
+	OS             *osinfo.Info `json:"os"`
 	Patched        bool         `json:"patched"`
 	RebootRequired bool         `json:"reboot_required"`
 	RebootReason   string       `json:"reboot_reason,omitempty"`
-	Steps          []Step       `json:"steps"`
+	AppliedPatches []string     `json:"applied_patches,omitempty"`
+	SecurityFilter string       `json:"security_filter,omitempty"` // how security_only was applied
+	// Changes is set by sources that know what they changed better than an
+	// installed-package diff can tell, e.g. firmware staged for next boot.
+	Changes []PackageChange `json:"changes,omitempty"`
+	// Plan is what a dry run would change, parsed from the backend's
+	// simulation output.
+	Plan  []PackageChange `json:"plan,omitempty"`
+	Steps []Step          `json:"steps"`
 }
 
+// PendingUpdate describes a package that the backend would upgrade.
+// Fields the backend cannot determine are left empty.
+type PendingUpdate struct {
+	Name       string `json:"name"`
+	Arch       string `json:"arch,omitempty"`
+	Current    string `json:"current_version,omitempty"`
+	Candidate  string `json:"candidate_version"`
+	Repository string `json:"repository,omitempty"`
+	Security   bool   `json:"security"`
+}
+
+// Phase splits a run for tight maintenance windows. PhaseDownload only
+// refreshes metadata and fetches packages; PhaseInstall installs what was
+// fetched without refreshing metadata first, so the candidates stay the
+// ones that were downloaded. The zero value does both.
+type Phase string
+
+const (
+	PhaseAll      Phase = ""
+	PhaseDownload Phase = "download"
+	PhaseInstall  Phase = "install"
+)
+
 type Options struct {
 	DryRun          bool
 	SecurityOnly    bool
 	ExcludePackages []string
+	// IncludePackages, when set, limits the run to upgrading installed
+	// packages matching these patterns.
+	IncludePackages []string
 	AllowKernel     bool
-	Timeout         time.Duration
-	Nice            int
-	Ionice          string
+	// MinSeverity limits SecurityOnly runs to advisories of this severity
+	// or higher (low|moderate|important|critical); empty takes all.
+	MinSeverity string
+	Phase       Phase
+	Timeout     time.Duration
+	Nice        int
+	Ionice      string
 }
 
 type Patcher interface {
 	Name() string
 	Patch(ctx context.Context, opt Options) (*PatchResult, error)
+	ListUpdates(ctx context.Context, opt Options) ([]PendingUpdate, error)
+	Installed(ctx context.Context) ([]InstalledPackage, error)
+}
+
+// Recoverer is implemented by backends that can detect a package
+// transaction interrupted by an earlier run (power loss, timeout, OOM) and
+// finish or clean it up. Recover returns an error when the package database
+// is still unusable afterwards.
+type Recoverer interface {
+	Recover(ctx context.Context, opt Options) ([]Step, error)
+}
+
+// PackageVersion names an exact package version to install.
+type PackageVersion struct {
+	Name    string `json:"name"`
+	Arch    string `json:"arch,omitempty"`
+	Version string `json:"version"`
+}
+
+// VersionInstaller is implemented by backends that can install exact
+// package versions, upgrading or downgrading as needed.
+type VersionInstaller interface {
+	InstallVersions(ctx context.Context, pkgs []PackageVersion, opt Options) (*PatchResult, error)
 }
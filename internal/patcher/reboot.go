@@ -0,0 +1,19 @@
+package patcher
+
+import "github.com/serverpatcher/serverpatcher/internal/reboot"
+
+// applyRebootCheck adds the distro-independent kernel and core-library
+// checks to whatever the backend's own tooling reported, so every backend
+// fills RebootRequired and RebootReason the same way.
+func applyRebootCheck(res *PatchResult) {
+	r := reboot.Check()
+	if !r.Required {
+		return
+	}
+	res.RebootRequired = true
+	if res.RebootReason == "" {
+		res.RebootReason = r.Reason()
+	} else {
+		res.RebootReason += "; " + r.Reason()
+	}
+}
@@ -0,0 +1,356 @@
+package patcher
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/serverpatcher/serverpatcher/internal/executil"
+)
+
+// rpmListUpdates is shared by the dnf and yum backends. check-update exits
+// with 100 when updates are available, which is not an error.
+func rpmListUpdates(ctx context.Context, cmd string, base []string) ([]PendingUpdate, error) {
+	args := append(append([]string{}, base...), "-q", "check-update")
+	r, err := executil.Run(ctx, cmd, args...)
+	if err != nil && (r == nil || r.ExitCode != 100) {
+		return nil, err
+	}
+	ups := parseCheckUpdate(r.Stdout)
+	if len(ups) == 0 {
+		return ups, nil
+	}
+
+	// Best-effort: not every repository ships updateinfo metadata.
+	secArgs := append(append([]string{}, base...), "-q", "check-update", "--security")
+	if sr, err := executil.Run(ctx, cmd, secArgs...); err == nil || (sr != nil && sr.ExitCode == 100) {
+		sec := map[string]bool{}
+		for _, u := range parseCheckUpdate(sr.Stdout) {
+			sec[u.Name+"."+u.Arch] = true
+		}
+		for i := range ups {
+			ups[i].Security = sec[ups[i].Name+"."+ups[i].Arch]
+		}
+	}
+
+	names := make([]string, 0, len(ups))
+	for _, u := range ups {
+		names = append(names, u.Name)
+	}
+	cur := rpmQueryVersions(ctx, names)
+	for i := range ups {
+		ups[i].Current = cur[ups[i].Name+"."+ups[i].Arch]
+	}
+	return ups, nil
+}
+
+// parseCheckUpdate parses `dnf/yum check-update` output. Long package names
+// make the columns wrap onto the next line, so a lone name.arch field is
+// joined with the following line.
+func parseCheckUpdate(out string) []PendingUpdate {
+	var ups []PendingUpdate
+	var pending []string
+	for _, line := range strings.Split(out, "\n") {
+		if strings.HasPrefix(line, "Obsoleting Packages") {
+			break
+		}
+		f := strings.Fields(line)
+		if len(pending) > 0 {
+			f = append(pending, f...)
+			pending = nil
+		}
+		if len(f) == 1 && strings.Contains(f[0], ".") {
+			pending = f
+			continue
+		}
+		if len(f) != 3 || f[1] == "" || f[1][0] < '0' || f[1][0] > '9' {
+			continue
+		}
+		name, arch, ok := splitRPMNameArch(f[0])
+		if !ok {
+			continue
+		}
+		ups = append(ups, PendingUpdate{Name: name, Arch: arch, Candidate: f[1], Repository: f[2]})
+	}
+	return ups
+}
+
+func splitRPMNameArch(s string) (name, arch string, ok bool) {
+	i := strings.LastIndex(s, ".")
+	if i <= 0 || i == len(s)-1 {
+		return "", "", false
+	}
+	return s[:i], s[i+1:], true
+}
+
+// rpmQueryVersions returns installed versions keyed by name.arch, using the
+// same [epoch:]version-release form that check-update prints.
+func rpmQueryVersions(ctx context.Context, names []string) map[string]string {
+	out := map[string]string{}
+	if len(names) == 0 {
+		return out
+	}
+	args := append([]string{"-q", "--qf", "%{NAME}.%{ARCH} %{EPOCH}:%{VERSION}-%{RELEASE}\n"}, names...)
+	// rpm exits non-zero if any name is not installed; use what it printed.
+	r, _ := executil.Run(ctx, "rpm", args...)
+	if r == nil {
+		return out
+	}
+	for _, line := range strings.Split(r.Stdout, "\n") {
+		f := strings.Fields(line)
+		if len(f) != 2 {
+			continue
+		}
+		out[f[0]] = rpmTrimEpoch(f[1])
+	}
+	return out
+}
+
+func rpmTrimEpoch(v string) string {
+	if strings.HasPrefix(v, "(none):") || strings.HasPrefix(v, "0:") {
+		return v[strings.Index(v, ":")+1:]
+	}
+	return v
+}
+
+// rpmSecurityArgs restricts an upgrade to security advisories, of at least
+// opt.MinSeverity if set. dnf and yum combine update filters as a union,
+// so --security would select every security advisory regardless of
+// severity; with MinSeverity only the --sec-severity filters (each matching
+// one severity exactly) are passed.
+func rpmSecurityArgs(opt Options) []string {
+	if opt.MinSeverity == "" {
+		return []string{"--security"}
+	}
+	var args []string
+	for _, s := range severitiesFrom(opt.MinSeverity) {
+		args = append(args, "--sec-severity="+strings.ToUpper(s[:1])+s[1:])
+	}
+	return args
+}
+
+// rpmPhaseArgs makes the download phase fetch into the cache without
+// installing, and the install phase use only the cache (-C): no metadata
+// refresh and no downloads.
+func rpmPhaseArgs(ph Phase) []string {
+	switch ph {
+	case PhaseDownload:
+		return []string{"--downloadonly"}
+	case PhaseInstall:
+		return []string{"-C"}
+	}
+	return nil
+}
+
+// rpmDeclined reports whether a failed --assumeno run only failed because
+// the transaction was declined, which is how dnf and yum end a dry run.
+func rpmDeclined(st Step) bool {
+	if st.Result == nil || st.Result.ExitCode != 1 {
+		return false
+	}
+	out := st.Result.Stdout + "\n" + st.Result.Stderr
+	return strings.Contains(out, "Operation aborted") || strings.Contains(out, "Exiting on user command")
+}
+
+// rpmTransactionSections maps dnf and yum transaction table headings to
+// actions. Headings are matched by prefix, so "Installing dependencies"
+// and "Updating for dependencies" are covered too.
+var rpmTransactionSections = []struct {
+	prefix string
+	action ChangeAction
+}{
+	{"Upgrading", ChangeUpgraded},
+	{"Updating", ChangeUpgraded},
+	{"Installing", ChangeInstalled},
+	{"Removing", ChangeRemoved},
+	{"Erasing", ChangeRemoved},
+}
+
+// parseRPMTransaction parses the transaction table dnf and yum print before
+// asking for confirmation:
+//
+//	Upgrading:
+//	 openssl-libs     x86_64     1:3.0.7-25.el9_3     baseos     2.1 M
+//
+// Upgrade rows carry only the new version; removals only the installed one.
+// Rows of sections not in rpmTransactionSections (e.g. Downgrading) are
+// skipped.
+func parseRPMTransaction(out string) []PackageChange {
+	var plan []PackageChange
+	var action ChangeAction
+	var pending []string
+	for _, line := range strings.Split(out, "\n") {
+		if strings.HasPrefix(line, "Transaction Summary") {
+			break
+		}
+		if line != "" && line[0] != ' ' && strings.HasSuffix(line, ":") {
+			action = ""
+			for _, s := range rpmTransactionSections {
+				if strings.HasPrefix(line, s.prefix) {
+					action = s.action
+					break
+				}
+			}
+			pending = nil
+			continue
+		}
+		if action == "" || !strings.HasPrefix(line, " ") {
+			continue
+		}
+		f := strings.Fields(line)
+		if len(pending) > 0 {
+			f = append(pending, f...)
+			pending = nil
+		}
+		// Long package names push the remaining columns onto the next line.
+		if len(f) == 1 {
+			pending = f
+			continue
+		}
+		if len(f) < 4 || f[0] == "replacing" {
+			continue
+		}
+		c := PackageChange{Name: f[0], Arch: f[1], Action: action}
+		if action == ChangeRemoved {
+			c.OldVersion = rpmTrimEpoch(f[2])
+		} else {
+			c.NewVersion = rpmTrimEpoch(f[2])
+		}
+		plan = append(plan, c)
+	}
+	return plan
+}
+
+// rpmPlan parses a dry-run transaction and fills in the installed versions
+// of the packages it would upgrade.
+func rpmPlan(ctx context.Context, out string) []PackageChange {
+	plan := parseRPMTransaction(out)
+	var names []string
+	for _, c := range plan {
+		if c.Action == ChangeUpgraded {
+			names = append(names, c.Name)
+		}
+	}
+	cur := rpmQueryVersions(ctx, names)
+	for i, c := range plan {
+		if c.Action == ChangeUpgraded {
+			plan[i].OldVersion = cur[c.Name+"."+c.Arch]
+		}
+	}
+	return plan
+}
+
+// rpmSpecs formats name-[epoch:]version-release[.arch] specs for dnf and yum.
+func rpmSpecs(pkgs []PackageVersion) []string {
+	specs := make([]string, 0, len(pkgs))
+	for _, pv := range pkgs {
+		spec := pv.Name + "-" + pv.Version
+		if pv.Arch != "" {
+			spec += "." + pv.Arch
+		}
+		specs = append(specs, spec)
+	}
+	return specs
+}
+
+type updateinfoEntry struct {
+	id, severity           string
+	nevra, name, arch, evr string
+}
+
+// parseUpdateinfo parses `updateinfo list` lines, "[i] ID TYPE NEVRA" with
+// TYPE such as "Important/Sec.", keeping only security advisories. The ID
+// column holds CVEs instead of advisory IDs in the CVE listing.
+func parseUpdateinfo(out string) []updateinfoEntry {
+	var entries []updateinfoEntry
+	for _, line := range strings.Split(out, "\n") {
+		f := strings.Fields(line)
+		if len(f) == 4 && f[0] == "i" {
+			f = f[1:]
+		}
+		if len(f) != 3 || !strings.Contains(strings.ToLower(f[1]), "sec") {
+			continue
+		}
+		sev, _, _ := strings.Cut(f[1], "/")
+		e := updateinfoEntry{id: f[0], severity: NormalizeSeverity(sev), nevra: f[2]}
+		rest := f[2]
+		if i := strings.LastIndex(rest, "."); i > 0 {
+			e.arch = rest[i+1:]
+			rest = rest[:i]
+		}
+		// name-[epoch:]version-release
+		r := strings.LastIndex(rest, "-")
+		if r <= 0 {
+			continue
+		}
+		v := strings.LastIndex(rest[:r], "-")
+		if v <= 0 {
+			continue
+		}
+		e.name, e.evr = rest[:v], rest[v+1:]
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+// rpmAdvisories joins the advisory listing (listArgs) with the CVE listing
+// (cveArgs) by NEVRA, for the packages in changes. The CVE listing is
+// best-effort: without it the advisories are still reported.
+func rpmAdvisories(ctx context.Context, cmd string, listArgs, cveArgs []string, changes []PackageChange) ([]Advisory, error) {
+	names := map[string]bool{}
+	for _, c := range changes {
+		names[c.Name] = true
+	}
+	r, err := executil.Run(ctx, cmd, listArgs...)
+	if err != nil {
+		return nil, err
+	}
+	var advs []Advisory
+	byNEVRA := map[string][]int{}
+	for _, e := range parseUpdateinfo(r.Stdout) {
+		if !names[e.name] {
+			continue
+		}
+		byNEVRA[e.nevra] = append(byNEVRA[e.nevra], len(advs))
+		advs = append(advs, Advisory{ID: e.id, Severity: e.severity, Package: e.name, Arch: e.arch, Version: e.evr})
+	}
+	if len(advs) == 0 {
+		return nil, nil
+	}
+	if r, err := executil.Run(ctx, cmd, cveArgs...); err == nil {
+		for _, e := range parseUpdateinfo(r.Stdout) {
+			for _, i := range byNEVRA[e.nevra] {
+				advs[i].CVEs = appendUnique(advs[i].CVEs, e.id)
+			}
+		}
+	}
+	return advs, nil
+}
+
+// rpmBuildTimeFormat makes repoquery print "name arch epoch:version-release
+// buildtime" per line, tab separated.
+const rpmBuildTimeFormat = "%{name}\t%{arch}\t%{epoch}:%{version}-%{release}\t%{buildtime}\n"
+
+// rpmPublishTimes runs a repoquery printing rpmBuildTimeFormat and returns
+// the build time of each update's candidate.
+func rpmPublishTimes(ctx context.Context, cmd string, args []string, ups []PendingUpdate) ([]time.Time, error) {
+	r, err := executil.Run(ctx, cmd, args...)
+	if err != nil {
+		return nil, err
+	}
+	built := map[string]time.Time{}
+	for _, line := range strings.Split(r.Stdout, "\n") {
+		f := strings.Split(strings.TrimSpace(line), "\t")
+		if len(f) != 4 {
+			continue
+		}
+		if t, ok := parseBuildTime(f[3]); ok {
+			built[f[0]+"."+f[1]+" "+rpmTrimEpoch(f[2])] = t
+		}
+	}
+	out := make([]time.Time, len(ups))
+	for i, u := range ups {
+		out[i] = built[u.Name+"."+u.Arch+" "+rpmTrimEpoch(u.Candidate)]
+	}
+	return out, nil
+}
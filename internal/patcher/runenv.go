@@ -45,17 +45,9 @@ func runCommandWithEnv(ctx context.Context, name string, args []string, env []st
 }
 
 func runStepWithEnv(ctx context.Context, name string, cmd string, args []string, env []string) (Step, error) {
-	st := Step{Name: name, Started: time.Now()}
-	res, err := runCommandWithEnv(ctx, cmd, args, env)
-	st.Ended = time.Now()
-	if res != nil {
-		st.Result = res
-	}
-	if err != nil {
-		st.Error = err.Error()
-		return st, err
-	}
-	return st, nil
+	return retryStep(ctx, name, func() (*executil.Result, error) {
+		return runCommandWithEnv(ctx, cmd, args, env)
+	})
 }
 
 func fileExists(path string) bool {
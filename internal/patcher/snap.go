@@ -0,0 +1,106 @@
+package patcher
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/serverpatcher/serverpatcher/internal/executil"
+	"github.com/serverpatcher/serverpatcher/internal/osinfo"
+)
+
+// Snap is a secondary source; it never replaces the distro backend.
+type Snap struct{}
+
+func (p *Snap) Name() string { return "snap" }
+
+func (p *Snap) Patch(ctx context.Context, opt Options) (*PatchResult, error) {
+	info, _ := osinfo.Detect()
+	res := &PatchResult{Backend: p.Name(), OS: info}
+	localCtx, cancel := context.WithTimeout(ctx, opt.Timeout)
+	defer cancel()
+
+	if opt.SecurityOnly {
+		return res, fmt.Errorf("security_only is not supported for snaps: the store publishes no security metadata")
+	}
+
+	steps := []Step{}
+	cmd, base := prefixWithQoS("snap", nil, opt.Nice, opt.Ionice)
+
+	// Dry runs and excludes both need the list of pending refreshes.
+	var selected []string
+	if opt.DryRun || len(opt.ExcludePackages) > 0 {
+		st, err := runStep(localCtx, "snap_refresh_list", "snap", []string{"refresh", "--list"})
+		steps = append(steps, st)
+		if err != nil {
+			res.Steps = steps
+			return res, err
+		}
+		for _, u := range parseSnapTable(st.Result.Stdout) {
+			if !matchAny(u.Name, opt.ExcludePackages) {
+				selected = append(selected, u.Name)
+			}
+		}
+		if opt.DryRun || len(selected) == 0 {
+			res.Patched = opt.DryRun
+			res.Steps = steps
+			return res, nil
+		}
+	}
+
+	args := append(append(append([]string{}, base...), "refresh"), selected...)
+	st, err := runStep(localCtx, "snap_refresh", cmd, args)
+	steps = append(steps, st)
+	if err != nil {
+		res.Steps = steps
+		return res, err
+	}
+	res.Patched = true
+
+	res.Steps = steps
+	return res, nil
+}
+
+func (p *Snap) ListUpdates(ctx context.Context, opt Options) ([]PendingUpdate, error) {
+	localCtx, cancel := context.WithTimeout(ctx, opt.Timeout)
+	defer cancel()
+
+	r, err := executil.Run(localCtx, "snap", "refresh", "--list")
+	if err != nil {
+		return nil, err
+	}
+	ups := []PendingUpdate{}
+	cur := map[string]string{}
+	if installed, err := p.Installed(localCtx); err == nil {
+		for _, i := range installed {
+			cur[i.Name] = i.Version
+		}
+	}
+	for _, u := range parseSnapTable(r.Stdout) {
+		ups = append(ups, PendingUpdate{Name: u.Name, Current: cur[u.Name], Candidate: u.Version})
+	}
+	return ups, nil
+}
+
+func (p *Snap) Installed(ctx context.Context) ([]InstalledPackage, error) {
+	r, err := executil.Run(ctx, "snap", "list")
+	if err != nil {
+		return nil, err
+	}
+	return parseSnapTable(r.Stdout), nil
+}
+
+// parseSnapTable parses `snap list` and `snap refresh --list`, which both
+// start with Name, Version and Rev columns. The revision is part of the
+// version because a refresh can keep the version string.
+func parseSnapTable(out string) []InstalledPackage {
+	var pkgs []InstalledPackage
+	for _, line := range strings.Split(out, "\n") {
+		f := strings.Fields(line)
+		if len(f) < 3 || f[0] == "Name" {
+			continue
+		}
+		pkgs = append(pkgs, InstalledPackage{Name: f[0], Version: f[1] + " (rev " + f[2] + ")"})
+	}
+	return pkgs
+}
@@ -8,18 +8,65 @@ import (
 	"github.com/serverpatcher/serverpatcher/internal/executil"
 )
 
+// Transient failures are retried up to retryAttempts times in total,
+// waiting retryBackoff before the first retry and doubling it after.
+var (
+	retryAttempts = 3
+	retryBackoff  = 15 * time.Second
+)
+
 func runStep(ctx context.Context, name string, cmd string, args []string) (Step, error) {
+	return retryStep(ctx, name, func() (*executil.Result, error) {
+		return executil.Run(ctx, cmd, args...)
+	})
+}
+
+// retryStep runs fn, classifies a failure and retries network and lock
+// failures while the context deadline leaves room for the backoff.
+func retryStep(ctx context.Context, name string, fn func() (*executil.Result, error)) (Step, error) {
 	st := Step{Name: name, Started: time.Now()}
-	res, err := executil.Run(ctx, cmd, args...)
-	st.Ended = time.Now()
-	if res != nil {
+	backoff := retryBackoff
+	for attempt := 1; ; attempt++ {
+		res, err := fn()
+		st.Ended = time.Now()
 		st.Result = res
-	}
-	if err != nil {
+		if attempt > 1 {
+			st.Attempts = attempt
+		}
+		if err == nil {
+			st.accept()
+			return st, nil
+		}
 		st.Error = err.Error()
-		return st, err
+		st.Category = Classify(stepBackend(name), res)
+		if !st.Category.Transient() || attempt >= retryAttempts || !sleepCtx(ctx, backoff) {
+			return st, err
+		}
+		backoff *= 2
+	}
+}
+
+// sleepCtx waits for d unless ctx ends first or its deadline is closer
+// than d.
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	if dl, ok := ctx.Deadline(); ok && time.Until(dl) < d {
+		return false
 	}
-	return st, nil
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// accept marks a failed step as expected, e.g. an exit code that only
+// signals a pending reboot.
+func (s *Step) accept() {
+	s.Error = ""
+	s.Category = ""
 }
 
 // prefixWithQoS wraps commands with nice/ionice where available and configured.
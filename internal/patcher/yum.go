@@ -2,10 +2,15 @@ package patcher
 
 import (
 	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/serverpatcher/serverpatcher/internal/executil"
 	"github.com/serverpatcher/serverpatcher/internal/osinfo"
+	"github.com/serverpatcher/serverpatcher/internal/pkgver"
 )
 
 type Yum struct{}
@@ -21,7 +26,7 @@ func (p *Yum) Patch(ctx context.Context, opt Options) (*PatchResult, error) {
 	steps := []Step{}
 	cmd, base := prefixWithQoS("yum", nil, opt.Nice, opt.Ionice)
 
-	{
+	if opt.Phase != PhaseInstall {
 		args := append(append([]string{}, base...), "-y", "makecache")
 		st, err := runStep(localCtx, "yum_makecache", cmd, args)
 		steps = append(steps, st)
@@ -31,11 +36,28 @@ func (p *Yum) Patch(ctx context.Context, opt Options) (*PatchResult, error) {
 		}
 	}
 
+	var names []string
+	if len(opt.IncludePackages) > 0 {
+		var err error
+		if names, err = includedInstalled(localCtx, p, opt); err != nil {
+			res.Steps = steps
+			return res, err
+		}
+		if len(names) == 0 {
+			applyRebootCheck(res)
+			res.Steps = steps
+			return res, nil
+		}
+	}
+
 	{
 		args := []string{"-y", "update"}
 		if opt.SecurityOnly {
-			args = []string{"-y", "update", "--security"}
+			sec := rpmSecurityArgs(opt)
+			args = append(args, sec...)
+			res.SecurityFilter = strings.Join(sec, " ")
 		}
+		args = append(args, rpmPhaseArgs(opt.Phase)...)
 		if opt.DryRun {
 			args = append(args, "--assumeno")
 		}
@@ -45,14 +67,23 @@ func (p *Yum) Patch(ctx context.Context, opt Options) (*PatchResult, error) {
 		for _, ex := range opt.ExcludePackages {
 			args = append(args, "--exclude="+ex)
 		}
-		args = append(append([]string{}, base...), args...)
-		st, err := runStep(localCtx, "yum_update", cmd, args)
+		args = append(append(append([]string{}, base...), args...), names...)
+		// The transaction table is parsed for the dry-run plan, so keep its
+		// headings in English.
+		st, err := runStepWithEnv(localCtx, "yum_update", cmd, args, append(os.Environ(), "LC_ALL=C"))
+		if err != nil && opt.DryRun && rpmDeclined(st) {
+			st.accept()
+			err = nil
+		}
 		steps = append(steps, st)
 		if err != nil {
 			res.Steps = steps
 			return res, err
 		}
-		res.Patched = true
+		res.Patched = opt.Phase != PhaseDownload
+		if opt.DryRun {
+			res.Plan = rpmPlan(localCtx, st.Result.Stdout)
+		}
 	}
 
 	if _, ok := executil.LookPathAny("needs-restarting"); ok {
@@ -63,7 +94,7 @@ func (p *Yum) Patch(ctx context.Context, opt Options) (*PatchResult, error) {
 		if err != nil && r != nil && r.ExitCode == 1 {
 			res.RebootRequired = true
 			res.RebootReason = "needs-restarting indicates reboot required"
-			st.Error = ""
+			st.accept()
 			err = nil
 		}
 		if err != nil {
@@ -72,6 +103,161 @@ func (p *Yum) Patch(ctx context.Context, opt Options) (*PatchResult, error) {
 		steps = append(steps, st)
 	}
 
+	applyRebootCheck(res)
 	res.Steps = steps
 	return res, nil
 }
+
+func (p *Yum) ListUpdates(ctx context.Context, opt Options) ([]PendingUpdate, error) {
+	localCtx, cancel := context.WithTimeout(ctx, opt.Timeout)
+	defer cancel()
+
+	cmd, base := prefixWithQoS("yum", nil, opt.Nice, opt.Ionice)
+	if opt.Phase == PhaseInstall {
+		base = append(base, "-C")
+	}
+	return rpmListUpdates(localCtx, cmd, base)
+}
+
+func (p *Yum) Installed(ctx context.Context) ([]InstalledPackage, error) {
+	return installedRPM(ctx)
+}
+
+// InstallVersions splits the targets because `yum install` never
+// downgrades: older versions than installed go through `yum downgrade`.
+func (p *Yum) InstallVersions(ctx context.Context, pkgs []PackageVersion, opt Options) (*PatchResult, error) {
+	info, _ := osinfo.Detect()
+	res := &PatchResult{Backend: p.Name(), OS: info}
+	localCtx, cancel := context.WithTimeout(ctx, opt.Timeout)
+	defer cancel()
+
+	names := make([]string, 0, len(pkgs))
+	for _, pv := range pkgs {
+		names = append(names, pv.Name)
+	}
+	installed := rpmQueryVersions(localCtx, names)
+
+	var up, down []PackageVersion
+	for _, pv := range pkgs {
+		if cur, ok := installed[pv.Name+"."+pv.Arch]; ok && pkgver.Compare(pv.Version, cur) < 0 {
+			down = append(down, pv)
+		} else {
+			up = append(up, pv)
+		}
+	}
+
+	steps := []Step{}
+	cmd, base := prefixWithQoS("yum", nil, opt.Nice, opt.Ionice)
+	for _, group := range []struct {
+		verb string
+		pkgs []PackageVersion
+	}{{"downgrade", down}, {"install", up}} {
+		if len(group.pkgs) == 0 {
+			continue
+		}
+		args := []string{"-y", group.verb}
+		if opt.DryRun {
+			args = append(args, "--assumeno")
+		}
+		args = append(append(append([]string{}, base...), args...), rpmSpecs(group.pkgs)...)
+		st, err := runStep(localCtx, "yum_"+group.verb+"_versions", cmd, args)
+		if err != nil && opt.DryRun && rpmDeclined(st) {
+			st.accept()
+			err = nil
+		}
+		steps = append(steps, st)
+		if err != nil {
+			res.Steps = steps
+			return res, err
+		}
+	}
+	res.Patched = true
+
+	applyRebootCheck(res)
+	res.Steps = steps
+	return res, nil
+}
+
+var yumTransactionDir = "/var/lib/yum"
+
+// Recover completes a transaction an earlier yum run left unfinished, which
+// yum records as transaction-all.* journal files.
+func (p *Yum) Recover(ctx context.Context, opt Options) ([]Step, error) {
+	pending, _ := filepath.Glob(filepath.Join(yumTransactionDir, "transaction-all.*"))
+	if len(pending) == 0 {
+		return nil, nil
+	}
+	if _, ok := executil.LookPathAny("yum-complete-transaction"); !ok {
+		return nil, fmt.Errorf("an interrupted yum transaction is pending (%s) but yum-complete-transaction (yum-utils) is not installed", pending[0])
+	}
+	localCtx, cancel := context.WithTimeout(ctx, opt.Timeout)
+	defer cancel()
+
+	st, err := runStep(localCtx, "yum_complete_transaction", "yum-complete-transaction", []string{"-y"})
+	return []Step{st}, err
+}
+
+// Cleanup removes kernels beyond the newest c.KeepKernels with
+// package-cleanup (yum-utils), which keeps the running kernel, then
+// autoremoves orphans and cached packages.
+func (p *Yum) Cleanup(ctx context.Context, opt Options, c CleanupOptions) ([]Step, error) {
+	localCtx, cancel := context.WithTimeout(ctx, opt.Timeout)
+	defer cancel()
+
+	var steps []Step
+	if c.KeepKernels > 0 {
+		if _, ok := executil.LookPathAny("package-cleanup"); !ok {
+			return nil, fmt.Errorf("removing old kernels on yum needs package-cleanup (yum-utils)")
+		}
+		cmd, args := prefixWithQoS("package-cleanup", []string{"-y", "--oldkernels", "--count=" + intToString(c.KeepKernels)}, opt.Nice, opt.Ionice)
+		st, err := runStep(localCtx, "yum_remove_old_kernels", cmd, args)
+		steps = append(steps, st)
+		if err != nil {
+			return steps, err
+		}
+	}
+	cmd, base := prefixWithQoS("yum", nil, opt.Nice, opt.Ionice)
+	for _, s := range []struct {
+		on   bool
+		name string
+		args []string
+	}{
+		{c.Autoremove, "yum_autoremove", []string{"-y", "autoremove"}},
+		{c.CleanCache, "yum_clean", []string{"clean", "packages"}},
+	} {
+		if !s.on {
+			continue
+		}
+		st, err := runStep(localCtx, s.name, cmd, append(append([]string{}, base...), s.args...))
+		steps = append(steps, st)
+		if err != nil {
+			return steps, err
+		}
+	}
+	return steps, nil
+}
+
+// Advisories lists the security advisories of the changed packages from
+// updateinfo metadata. yum takes "cves" as a list argument where dnf has
+// --with-cve.
+func (p *Yum) Advisories(ctx context.Context, changes []PackageChange, opt Options) ([]Advisory, error) {
+	localCtx, cancel := context.WithTimeout(ctx, opt.Timeout)
+	defer cancel()
+
+	base := []string{"-q", "updateinfo", "list", "all"}
+	return rpmAdvisories(localCtx, "yum", base, append(append([]string{}, base...), "cves"), changes)
+}
+
+// PublishTimes reads candidate build times from repository metadata with
+// repoquery (yum-utils).
+func (p *Yum) PublishTimes(ctx context.Context, ups []PendingUpdate, opt Options) ([]time.Time, error) {
+	if _, ok := executil.LookPathAny("repoquery"); !ok {
+		return nil, fmt.Errorf("repoquery (yum-utils) is not installed")
+	}
+	localCtx, cancel := context.WithTimeout(ctx, opt.Timeout)
+	defer cancel()
+
+	cmd, base := prefixWithQoS("repoquery", nil, opt.Nice, opt.Ionice)
+	args := append(append([]string{}, base...), "-q", "--pkgnarrow=updates", "-a", "--qf", rpmBuildTimeFormat)
+	return rpmPublishTimes(localCtx, cmd, args, ups)
+}
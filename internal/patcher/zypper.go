@@ -2,7 +2,12 @@ package patcher
 
 import (
 	"context"
+	"encoding/xml"
+	"os"
+	"strings"
+	"time"
 
+	"github.com/serverpatcher/serverpatcher/internal/executil"
 	"github.com/serverpatcher/serverpatcher/internal/osinfo"
 )
 
@@ -19,7 +24,7 @@ func (p *Zypper) Patch(ctx context.Context, opt Options) (*PatchResult, error) {
 	steps := []Step{}
 	cmd, base := prefixWithQoS("zypper", nil, opt.Nice, opt.Ionice)
 
-	{
+	if opt.Phase != PhaseInstall {
 		args := append(append([]string{}, base...), "--non-interactive", "--gpg-auto-import-keys", "refresh")
 		st, err := runStep(localCtx, "zypper_refresh", cmd, args)
 		steps = append(steps, st)
@@ -29,10 +34,32 @@ func (p *Zypper) Patch(ctx context.Context, opt Options) (*PatchResult, error) {
 		}
 	}
 
+	// zypper patch cannot be narrowed to packages, so with
+	// include_packages security_only does not apply.
+	if opt.SecurityOnly && len(opt.IncludePackages) == 0 {
+		return p.patchSecurity(localCtx, opt, res, steps, cmd, base)
+	}
+
+	var names []string
+	if len(opt.IncludePackages) > 0 {
+		var err error
+		if names, err = includedInstalled(localCtx, p, opt); err != nil {
+			res.Steps = steps
+			return res, err
+		}
+		if len(names) == 0 {
+			applyRebootCheck(res)
+			res.Steps = steps
+			return res, nil
+		}
+	}
+
 	{
 		args := []string{"--non-interactive", "update"}
 		if opt.DryRun {
-			args = []string{"--non-interactive", "--dry-run", "update"}
+			// The XML install summary carries old and new versions, which
+			// the human-readable summary leaves out.
+			args = []string{"--non-interactive", "--xmlout", "--dry-run", "update"}
 		}
 		if !opt.AllowKernel {
 			args = append(args, "--exclude", "kernel*")
@@ -40,16 +67,544 @@ func (p *Zypper) Patch(ctx context.Context, opt Options) (*PatchResult, error) {
 		for _, ex := range opt.ExcludePackages {
 			args = append(args, "--exclude", ex)
 		}
-		args = append(append([]string{}, base...), args...)
+		args = zypperPhaseArgs(opt.Phase, args)
+		args = append(append(append([]string{}, base...), args...), names...)
 		st, err := runStep(localCtx, "zypper_update", cmd, args)
 		steps = append(steps, st)
 		if err != nil {
 			res.Steps = steps
 			return res, err
 		}
-		res.Patched = true
+		res.Patched = opt.Phase != PhaseDownload
+		if opt.DryRun {
+			res.Plan = parseZypperSummary(st.Result.Stdout)
+		}
+	}
+
+	applyRebootCheck(res)
+	res.Steps = steps
+	return res, nil
+}
+
+// zypperPhaseArgs adds --download-only to the command for the download
+// phase, or the global --no-refresh for the install phase so zypper keeps
+// the metadata the packages were downloaded against.
+func zypperPhaseArgs(ph Phase, args []string) []string {
+	switch ph {
+	case PhaseDownload:
+		return append(args, "--download-only")
+	case PhaseInstall:
+		return append([]string{"--no-refresh"}, args...)
+	}
+	return args
+}
+
+// zypper patch reports some outcomes through informational exit codes.
+const (
+	zypperExitRebootNeeded  = 102
+	zypperExitRestartNeeded = 103
+)
+
+// patchSecurity applies security patches with `zypper patch`, which unlike
+// `zypper update` honours patch categories. Excludes are enforced with
+// temporary package locks; a security patch that needs a locked package
+// makes zypper stop with a conflict rather than ignore the lock.
+func (p *Zypper) patchSecurity(ctx context.Context, opt Options, res *PatchResult, steps []Step, cmd string, base []string) (*PatchResult, error) {
+	env := append(os.Environ(), "LC_ALL=C")
+
+	filter := []string{"--category", "security"}
+	if opt.MinSeverity != "" {
+		for _, s := range severitiesFrom(opt.MinSeverity) {
+			filter = append(filter, "--severity", s)
+		}
+	}
+	res.SecurityFilter = strings.Join(filter, " ")
+
+	before, st, err := zypperNeededPatches(ctx, "zypper_list_patches", filter, env)
+	steps = append(steps, st)
+	if err != nil {
+		res.Steps = steps
+		return res, err
+	}
+
+	locked, lockStep, err := zypperLock(ctx, opt, env)
+	if lockStep != nil {
+		steps = append(steps, *lockStep)
+	}
+	if len(locked) > 0 {
+		defer func() {
+			// ctx may already have expired if the run timed out.
+			relCtx, relCancel := context.WithTimeout(context.Background(), 2*time.Minute)
+			defer relCancel()
+			st, _ := runStepWithEnv(relCtx, "zypper_removelock", "zypper", append([]string{"--non-interactive", "removelock"}, locked...), env)
+			res.Steps = append(res.Steps, st)
+		}()
+	}
+	if err != nil {
+		res.Steps = steps
+		return res, err
+	}
+
+	// A patch to the package stack itself (exit 103) must be followed by a
+	// second pass to pick up the remaining patches.
+	for pass := 0; pass < 2; pass++ {
+		args := append([]string{"--non-interactive", "patch"}, filter...)
+		if opt.DryRun {
+			args = append([]string{"--non-interactive", "--xmlout", "--dry-run", "patch"}, filter...)
+		}
+		args = zypperPhaseArgs(opt.Phase, args)
+		args = append(append([]string{}, base...), args...)
+		st, err := runStep(ctx, "zypper_patch", cmd, args)
+		code := 0
+		if st.Result != nil {
+			code = st.Result.ExitCode
+		}
+		if err != nil && (code == zypperExitRebootNeeded || code == zypperExitRestartNeeded) {
+			st.accept()
+			err = nil
+		}
+		steps = append(steps, st)
+		if err != nil {
+			res.Steps = steps
+			return res, err
+		}
+		if opt.DryRun {
+			res.Plan = parseZypperSummary(st.Result.Stdout)
+		}
+		if code == zypperExitRebootNeeded {
+			res.RebootRequired = true
+			res.RebootReason = "zypper patch indicates reboot required"
+		}
+		// A download-only pass cannot apply the package stack patch that
+		// would reveal the remaining ones.
+		if code != zypperExitRestartNeeded || opt.DryRun || opt.Phase == PhaseDownload {
+			break
+		}
 	}
+	res.Patched = opt.Phase != PhaseDownload
 
+	// A dry run applies nothing, so it reports the patches it would apply.
+	if opt.DryRun {
+		res.AppliedPatches = before
+	}
+	if !opt.DryRun && opt.Phase != PhaseDownload {
+		after, st, err := zypperNeededPatches(ctx, "zypper_list_patches_after", filter, env)
+		steps = append(steps, st)
+		if err == nil {
+			still := map[string]bool{}
+			for _, id := range after {
+				still[id] = true
+			}
+			for _, id := range before {
+				if !still[id] {
+					res.AppliedPatches = append(res.AppliedPatches, id)
+				}
+			}
+		}
+	}
+
+	applyRebootCheck(res)
 	res.Steps = steps
 	return res, nil
 }
+
+// zypperNeededPatches returns the IDs of the patches matching filter that
+// still apply to the host.
+func zypperNeededPatches(ctx context.Context, stepName string, filter, env []string) ([]string, Step, error) {
+	st, err := runStepWithEnv(ctx, stepName, "zypper", append([]string{"--non-interactive", "list-patches"}, filter...), env)
+	if err != nil {
+		return nil, st, err
+	}
+	var ids []string
+	for _, row := range parseZypperTable(st.Result.Stdout) {
+		if row["Name"] != "" && row["Status"] == "needed" {
+			ids = append(ids, row["Name"])
+		}
+	}
+	return ids, st, nil
+}
+
+// zypperLock adds locks for exclude patterns (and kernel packages when kernel
+// updates are disallowed). It returns only the locks it added, so locks set
+// by the administrator are never removed.
+func zypperLock(ctx context.Context, opt Options, env []string) ([]string, *Step, error) {
+	patterns := append([]string{}, opt.ExcludePackages...)
+	if !opt.AllowKernel {
+		patterns = append(patterns, "kernel*")
+	}
+	if len(patterns) == 0 {
+		return nil, nil, nil
+	}
+
+	r, err := runCommandWithEnv(ctx, "zypper", []string{"--non-interactive", "locks"}, env)
+	if err != nil {
+		return nil, nil, err
+	}
+	existing := map[string]bool{}
+	for _, row := range parseZypperTable(r.Stdout) {
+		existing[row["Name"]] = true
+	}
+
+	var add []string
+	for _, pat := range patterns {
+		if !existing[pat] {
+			add = append(add, pat)
+		}
+	}
+	if len(add) == 0 {
+		return nil, nil, nil
+	}
+	st, err := runStepWithEnv(ctx, "zypper_addlock", "zypper", append([]string{"--non-interactive", "addlock"}, add...), env)
+	return add, &st, err
+}
+
+func (p *Zypper) ListUpdates(ctx context.Context, opt Options) ([]PendingUpdate, error) {
+	localCtx, cancel := context.WithTimeout(ctx, opt.Timeout)
+	defer cancel()
+
+	if opt.Phase != PhaseInstall {
+		cmd, base := prefixWithQoS("zypper", nil, opt.Nice, opt.Ionice)
+		args := append(append([]string{}, base...), "--non-interactive", "--gpg-auto-import-keys", "refresh")
+		if _, err := executil.Run(localCtx, cmd, args...); err != nil {
+			return nil, err
+		}
+	}
+	// Column headers are localized; force C so parseZypperTable finds them.
+	env := append(os.Environ(), "LC_ALL=C")
+	r, err := runCommandWithEnv(localCtx, "zypper", []string{"--non-interactive", "list-updates"}, env)
+	if err != nil {
+		return nil, err
+	}
+	var ups []PendingUpdate
+	for _, row := range parseZypperTable(r.Stdout) {
+		if row["Name"] == "" {
+			continue
+		}
+		ups = append(ups, PendingUpdate{
+			Name:       row["Name"],
+			Arch:       row["Arch"],
+			Current:    row["Current Version"],
+			Candidate:  row["Available Version"],
+			Repository: row["Repository"],
+		})
+	}
+
+	// list-updates does not say which updates fix what; the packages a
+	// dry-run security patch would upgrade are the security ones.
+	// Best-effort, like check-update --security on dnf and yum.
+	if len(ups) > 0 {
+		sr, _ := runCommandWithEnv(localCtx, "zypper", []string{"--non-interactive", "--xmlout", "--dry-run", "patch", "--category", "security"}, env)
+		if sr != nil {
+			sec := map[string]bool{}
+			for _, c := range parseZypperSummary(sr.Stdout) {
+				sec[c.Name+"."+c.Arch] = true
+			}
+			for i := range ups {
+				ups[i].Security = sec[ups[i].Name+"."+ups[i].Arch]
+			}
+		}
+	}
+	return ups, nil
+}
+
+// parseZypperTable parses zypper's "a | b | c" table output into rows keyed
+// by the header column names.
+func parseZypperTable(out string) []map[string]string {
+	var header []string
+	var rows []map[string]string
+	for _, line := range strings.Split(out, "\n") {
+		if !strings.Contains(line, "|") {
+			continue
+		}
+		cols := strings.Split(line, "|")
+		for i := range cols {
+			cols[i] = strings.TrimSpace(cols[i])
+		}
+		if header == nil {
+			header = cols
+			continue
+		}
+		if strings.Trim(line, "-+ ") == "" {
+			continue
+		}
+		row := map[string]string{}
+		for i, c := range cols {
+			if i < len(header) {
+				row[header[i]] = c
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+type zypperSolvable struct {
+	Type       string `xml:"type,attr"`
+	Name       string `xml:"name,attr"`
+	Arch       string `xml:"arch,attr"`
+	Edition    string `xml:"edition,attr"`
+	EditionOld string `xml:"edition-old,attr"`
+}
+
+// parseZypperSummary parses the <install-summary> element zypper --xmlout
+// prints for a transaction. Patches and patterns are listed alongside the
+// packages they pull in; only packages make it into the plan.
+func parseZypperSummary(out string) []PackageChange {
+	var doc struct {
+		Upgrade []zypperSolvable `xml:"install-summary>to-upgrade>solvable"`
+		Install []zypperSolvable `xml:"install-summary>to-install>solvable"`
+		Remove  []zypperSolvable `xml:"install-summary>to-remove>solvable"`
+	}
+	if err := xml.Unmarshal([]byte(out), &doc); err != nil {
+		return nil
+	}
+	var plan []PackageChange
+	add := func(list []zypperSolvable, action ChangeAction) {
+		for _, s := range list {
+			if s.Type != "" && s.Type != "package" {
+				continue
+			}
+			c := PackageChange{Name: s.Name, Arch: s.Arch, Action: action}
+			switch action {
+			case ChangeUpgraded:
+				c.OldVersion, c.NewVersion = s.EditionOld, s.Edition
+			case ChangeInstalled:
+				c.NewVersion = s.Edition
+			case ChangeRemoved:
+				c.OldVersion = s.Edition
+			}
+			plan = append(plan, c)
+		}
+	}
+	add(doc.Upgrade, ChangeUpgraded)
+	add(doc.Install, ChangeInstalled)
+	add(doc.Remove, ChangeRemoved)
+	return plan
+}
+
+func (p *Zypper) Installed(ctx context.Context) ([]InstalledPackage, error) {
+	return installedRPM(ctx)
+}
+
+func (p *Zypper) InstallVersions(ctx context.Context, pkgs []PackageVersion, opt Options) (*PatchResult, error) {
+	info, _ := osinfo.Detect()
+	res := &PatchResult{Backend: p.Name(), OS: info}
+	localCtx, cancel := context.WithTimeout(ctx, opt.Timeout)
+	defer cancel()
+
+	cmd, base := prefixWithQoS("zypper", nil, opt.Nice, opt.Ionice)
+	args := []string{"--non-interactive", "install", "--oldpackage"}
+	if opt.DryRun {
+		args = []string{"--non-interactive", "--dry-run", "install", "--oldpackage"}
+	}
+	for _, pv := range pkgs {
+		args = append(args, pv.Name+"="+pv.Version)
+	}
+	args = append(append([]string{}, base...), args...)
+	st, err := runStep(localCtx, "zypper_install_versions", cmd, args)
+	res.Steps = []Step{st}
+	if err != nil {
+		return res, err
+	}
+	res.Patched = true
+
+	applyRebootCheck(res)
+	return res, nil
+}
+
+var zyppConfPath = "/etc/zypp/zypp.conf"
+
+// Cleanup purges kernels beyond the newest c.KeepKernels and the running
+// one, removes packages nothing needs any more and empties the package
+// cache. purge-kernels takes what to keep only from zypp.conf, so it runs
+// with a copy whose multiversion.kernels is set accordingly.
+func (p *Zypper) Cleanup(ctx context.Context, opt Options, c CleanupOptions) ([]Step, error) {
+	localCtx, cancel := context.WithTimeout(ctx, opt.Timeout)
+	defer cancel()
+
+	env := append(os.Environ(), "LC_ALL=C")
+	cmd, base := prefixWithQoS("zypper", nil, opt.Nice, opt.Ionice)
+	var steps []Step
+	if c.KeepKernels > 0 {
+		conf, err := zyppKernelConf(c.KeepKernels)
+		if err != nil {
+			return steps, err
+		}
+		defer os.Remove(conf)
+		args := append(append([]string{}, base...), "--non-interactive", "purge-kernels")
+		st, err := runStepWithEnv(localCtx, "zypper_purge_kernels", cmd, args, append(env, "ZYPP_CONF="+conf))
+		steps = append(steps, st)
+		if err != nil {
+			return steps, err
+		}
+	}
+	if c.Autoremove {
+		r, err := runCommandWithEnv(localCtx, "zypper", []string{"--non-interactive", "packages", "--unneeded"}, env)
+		if err != nil {
+			return steps, err
+		}
+		var names []string
+		for _, row := range parseZypperTable(r.Stdout) {
+			if row["Name"] != "" && strings.HasPrefix(row["S"], "i") {
+				names = append(names, row["Name"])
+			}
+		}
+		if len(names) > 0 {
+			args := append(append(append([]string{}, base...), "--non-interactive", "remove", "--clean-deps"), names...)
+			st, err := runStepWithEnv(localCtx, "zypper_remove_unneeded", cmd, args, env)
+			steps = append(steps, st)
+			if err != nil {
+				return steps, err
+			}
+		}
+	}
+	if c.CleanCache {
+		st, err := runStepWithEnv(localCtx, "zypper_clean", cmd, append(append([]string{}, base...), "--non-interactive", "clean"), env)
+		steps = append(steps, st)
+		if err != nil {
+			return steps, err
+		}
+	}
+	return steps, nil
+}
+
+// zyppKernelConf writes a temporary copy of zypp.conf that keeps the keep
+// newest kernels and the running one, and returns its path.
+func zyppKernelConf(keep int) (string, error) {
+	b, err := os.ReadFile(zyppConfPath)
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	spec := []string{"latest"}
+	for i := 1; i < keep; i++ {
+		spec = append(spec, "latest-"+intToString(i))
+	}
+	spec = append(spec, "running")
+	setting := "multiversion.kernels = " + strings.Join(spec, ",")
+
+	var lines []string
+	inserted := false
+	for _, line := range strings.Split(string(b), "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "multiversion.kernels") {
+			continue
+		}
+		lines = append(lines, line)
+		if !inserted && strings.TrimSpace(line) == "[main]" {
+			lines = append(lines, setting)
+			inserted = true
+		}
+	}
+	if !inserted {
+		lines = append([]string{"[main]", setting}, lines...)
+	}
+
+	f, err := os.CreateTemp("", "serverpatcher-zypp-*.conf")
+	if err != nil {
+		return "", err
+	}
+	_, err = f.WriteString(strings.Join(lines, "\n"))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// Advisories maps patches with CVE references to the package versions they
+// fix: `list-patches --cve` gives the CVEs and severity of each patch and
+// `info -t patch` the versions it requires, listed as its conflicts.
+func (p *Zypper) Advisories(ctx context.Context, changes []PackageChange, opt Options) ([]Advisory, error) {
+	localCtx, cancel := context.WithTimeout(ctx, opt.Timeout)
+	defer cancel()
+
+	env := append(os.Environ(), "LC_ALL=C")
+	r, err := runCommandWithEnv(localCtx, "zypper", []string{"--non-interactive", "list-patches", "--all", "--cve"}, env)
+	if err != nil {
+		return nil, err
+	}
+	type patch struct {
+		severity string
+		cves     []string
+	}
+	patches := map[string]*patch{}
+	var ids []string
+	for _, row := range parseZypperTable(r.Stdout) {
+		id := row["Patch"]
+		// Patches that do not apply to installed packages are of no interest.
+		if id == "" || (row["Status"] != "applied" && row["Status"] != "needed") {
+			continue
+		}
+		pt, ok := patches[id]
+		if !ok {
+			pt = &patch{severity: NormalizeSeverity(row["Severity"])}
+			patches[id] = pt
+			ids = append(ids, id)
+		}
+		if strings.EqualFold(row["Issue"], "cve") {
+			pt.cves = appendUnique(pt.cves, row["No."])
+		}
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	r, err = runCommandWithEnv(localCtx, "zypper", append([]string{"--non-interactive", "info", "-t", "patch"}, ids...), env)
+	if err != nil {
+		return nil, err
+	}
+	names := map[string]bool{}
+	for _, c := range changes {
+		names[c.Name] = true
+	}
+	fixes := parseZypperPatchInfo(r.Stdout)
+	var advs []Advisory
+	for _, id := range ids {
+		for _, f := range fixes[id] {
+			if names[f.Name] {
+				advs = append(advs, Advisory{ID: id, Severity: patches[id].severity, CVEs: patches[id].cves, Package: f.Name, Arch: f.Arch, Version: f.Version})
+			}
+		}
+	}
+	return advs, nil
+}
+
+var rpmArches = map[string]bool{
+	"noarch": true, "x86_64": true, "i586": true, "i686": true, "aarch64": true,
+	"ppc64le": true, "s390x": true, "armv7hl": true, "riscv64": true,
+}
+
+// parseZypperPatchInfo reads the Conflicts section of each "Information for
+// patch ID:" block, lines such as "libopenssl3.x86_64 < 3.0.8-150500.5.27.1",
+// into the package versions each patch installs.
+func parseZypperPatchInfo(out string) map[string][]PackageVersion {
+	fixes := map[string][]PackageVersion{}
+	id := ""
+	inConflicts := false
+	for _, line := range strings.Split(out, "\n") {
+		if rest, ok := strings.CutPrefix(line, "Information for patch "); ok {
+			id = strings.TrimSuffix(strings.TrimSpace(rest), ":")
+			inConflicts = false
+			continue
+		}
+		if line == "" || (line[0] != ' ' && line[0] != '\t') {
+			key, _, _ := strings.Cut(line, ":")
+			inConflicts = strings.TrimSpace(key) == "Conflicts"
+			continue
+		}
+		f := strings.Fields(line)
+		if !inConflicts || id == "" || len(f) != 3 || f[1] != "<" {
+			continue
+		}
+		pv := PackageVersion{Name: f[0], Version: f[2]}
+		if i := strings.LastIndex(f[0], "."); i > 0 && rpmArches[f[0][i+1:]] {
+			pv.Name, pv.Arch = f[0][:i], f[0][i+1:]
+		} else if i > 0 && (f[0][i+1:] == "src" || f[0][i+1:] == "nosrc") {
+			continue
+		}
+		fixes[id] = append(fixes[id], pv)
+	}
+	return fixes
+}
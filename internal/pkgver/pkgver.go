@@ -0,0 +1,79 @@
+// Package pkgver compares package and kernel version strings.
+package pkgver
+
+// Compare orders two version strings the way rpmvercmp does, which is close
+// enough for dpkg, pacman and apk versions as well as kernel releases: the
+// strings are split into runs of digits and letters, digit runs compare
+// numerically and always sort after letter runs. It returns -1, 0 or 1.
+func Compare(a, b string) int {
+	for {
+		a = trimSeparators(a)
+		b = trimSeparators(b)
+		if a == "" || b == "" {
+			break
+		}
+		var sa, sb string
+		numeric := isDigit(a[0])
+		sa, a = nextSegment(a, numeric)
+		if isDigit(b[0]) != numeric {
+			if numeric {
+				return 1
+			}
+			return -1
+		}
+		sb, b = nextSegment(b, numeric)
+
+		if numeric {
+			sa = trimZeros(sa)
+			sb = trimZeros(sb)
+			if len(sa) != len(sb) {
+				if len(sa) > len(sb) {
+					return 1
+				}
+				return -1
+			}
+		}
+		if sa != sb {
+			if sa > sb {
+				return 1
+			}
+			return -1
+		}
+	}
+	switch {
+	case a == "" && b == "":
+		return 0
+	case a == "":
+		return -1
+	default:
+		return 1
+	}
+}
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
+
+func isAlpha(c byte) bool { return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') }
+
+func trimSeparators(s string) string {
+	i := 0
+	for i < len(s) && !isDigit(s[i]) && !isAlpha(s[i]) {
+		i++
+	}
+	return s[i:]
+}
+
+func nextSegment(s string, numeric bool) (seg, rest string) {
+	i := 0
+	for i < len(s) && (numeric && isDigit(s[i]) || !numeric && isAlpha(s[i])) {
+		i++
+	}
+	return s[:i], s[i:]
+}
+
+func trimZeros(s string) string {
+	i := 0
+	for i < len(s)-1 && s[i] == '0' {
+		i++
+	}
+	return s[i:]
+}
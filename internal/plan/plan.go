@@ -0,0 +1,190 @@
+// Package plan implements reviewable patch plans: a file listing the exact
+// package versions to install on one host, sealed so that edits after
+// review are detected. `serverpatcher plan` writes one, `serverpatcher
+// apply` installs exactly what it lists or refuses to run.
+package plan
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/serverpatcher/serverpatcher/internal/osinfo"
+	"github.com/serverpatcher/serverpatcher/internal/patcher"
+)
+
+const formatVersion = 1
+
+const (
+	AlgorithmSHA256     = "sha256"      // detects accidental edits only
+	AlgorithmHMACSHA256 = "hmac-sha256" // needs the key to forge
+)
+
+// Fingerprint identifies the host a plan was made on.
+type Fingerprint struct {
+	Hostname  string `json:"hostname"`
+	MachineID string `json:"machine_id,omitempty"`
+	OSID      string `json:"os_id"`
+	OSVersion string `json:"os_version"`
+}
+
+var machineIDPath = "/etc/machine-id"
+
+func HostFingerprint(info *osinfo.Info) Fingerprint {
+	host, _ := os.Hostname()
+	fp := Fingerprint{Hostname: host}
+	if b, err := os.ReadFile(machineIDPath); err == nil {
+		fp.MachineID = strings.TrimSpace(string(b))
+	}
+	if info != nil {
+		fp.OSID = info.ID
+		fp.OSVersion = info.VersionID
+	}
+	return fp
+}
+
+// Backend holds the planned updates of one package backend.
+type Backend struct {
+	Backend  string                  `json:"backend"`
+	Packages []patcher.PendingUpdate `json:"packages"`
+}
+
+type Plan struct {
+	Version   int         `json:"version"`
+	Created   time.Time   `json:"created"`
+	Host      Fingerprint `json:"host"`
+	Backends  []Backend   `json:"backends"`
+	Algorithm string      `json:"algorithm"`
+	Digest    string      `json:"digest"`
+}
+
+func New(host Fingerprint, backends []Backend) *Plan {
+	return &Plan{Version: formatVersion, Created: time.Now().UTC(), Host: host, Backends: backends}
+}
+
+// digest hashes the plan with an empty Digest field, keyed when key is set.
+func (p *Plan) digest(key []byte) (string, error) {
+	c := *p
+	c.Digest = ""
+	b, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	if p.Algorithm == AlgorithmHMACSHA256 {
+		m := hmac.New(sha256.New, key)
+		m.Write(b)
+		return hex.EncodeToString(m.Sum(nil)), nil
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Seal sets the digest: an HMAC when key is non-empty, a plain checksum
+// otherwise.
+func (p *Plan) Seal(key []byte) error {
+	p.Algorithm = AlgorithmSHA256
+	if len(key) > 0 {
+		p.Algorithm = AlgorithmHMACSHA256
+	}
+	d, err := p.digest(key)
+	if err != nil {
+		return err
+	}
+	p.Digest = d
+	return nil
+}
+
+// Verify checks the digest. With a key configured only HMAC-sealed plans
+// are accepted, since anyone can recompute a plain checksum.
+func (p *Plan) Verify(key []byte) error {
+	switch {
+	case p.Algorithm == AlgorithmHMACSHA256 && len(key) == 0:
+		return fmt.Errorf("plan is signed but no plan key is configured")
+	case p.Algorithm == AlgorithmSHA256 && len(key) > 0:
+		return fmt.Errorf("plan is only checksummed but a plan key is configured; re-create it")
+	case p.Algorithm != AlgorithmSHA256 && p.Algorithm != AlgorithmHMACSHA256:
+		return fmt.Errorf("unknown plan digest algorithm %q", p.Algorithm)
+	}
+	d, err := p.digest(key)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal([]byte(d), []byte(p.Digest)) {
+		return fmt.Errorf("plan digest mismatch: the plan was modified after it was created")
+	}
+	return nil
+}
+
+// Check rejects plans made on another host or more than maxAge ago.
+// maxAge <= 0 disables the age check.
+func (p *Plan) Check(host Fingerprint, maxAge time.Duration, now time.Time) error {
+	if p.Version != formatVersion {
+		return fmt.Errorf("unsupported plan version %d", p.Version)
+	}
+	if p.Host != host {
+		return fmt.Errorf("plan was made for %s (%s %s), this host is %s (%s %s)",
+			p.Host.Hostname, p.Host.OSID, p.Host.OSVersion, host.Hostname, host.OSID, host.OSVersion)
+	}
+	if maxAge > 0 && now.Sub(p.Created) > maxAge {
+		return fmt.Errorf("plan is %s old, older than the allowed %s", now.Sub(p.Created).Round(time.Minute), maxAge)
+	}
+	return nil
+}
+
+// Drift lists planned packages whose candidate version is no longer what
+// the repositories offer, including ones that are no longer upgradable.
+func Drift(planned, current []patcher.PendingUpdate) []string {
+	offered := map[string]string{}
+	for _, u := range current {
+		offered[u.Name+"."+u.Arch] = u.Candidate
+	}
+	var drift []string
+	for _, u := range planned {
+		cand, ok := offered[u.Name+"."+u.Arch]
+		switch {
+		case !ok:
+			drift = append(drift, fmt.Sprintf("%s: planned %s, no longer offered", u.Name, u.Candidate))
+		case cand != u.Candidate:
+			drift = append(drift, fmt.Sprintf("%s: planned %s, now %s", u.Name, u.Candidate, cand))
+		}
+	}
+	return drift
+}
+
+// Targets converts planned updates into exact versions to install.
+func Targets(ups []patcher.PendingUpdate) []patcher.PackageVersion {
+	out := make([]patcher.PackageVersion, 0, len(ups))
+	for _, u := range ups {
+		out = append(out, patcher.PackageVersion{Name: u.Name, Arch: u.Arch, Version: u.Candidate})
+	}
+	return out
+}
+
+func Write(path string, p *Plan) error {
+	b, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(b, '\n'), 0644)
+}
+
+// Read loads a plan and verifies its digest.
+func Read(path string, key []byte) (*Plan, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var p Plan
+	if err := json.Unmarshal(b, &p); err != nil {
+		return nil, fmt.Errorf("parse plan %s: %w", path, err)
+	}
+	if err := p.Verify(key); err != nil {
+		return nil, fmt.Errorf("plan %s: %w", path, err)
+	}
+	return &p, nil
+}
@@ -0,0 +1,137 @@
+// Package preflight checks that a host is fit to be patched: enough free
+// disk space and memory, and package repositories that can be reached. A
+// run that fails a check is skipped before anything is changed.
+package preflight
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var procDir = "/proc"
+
+// Check is the outcome of one preflight check. Name identifies what was
+// checked, e.g. "disk_space:/boot", "memory" or "repository:<url>".
+type Check struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// Space requires Min bytes to be available to unprivileged users on the
+// filesystem holding Path.
+type Space struct {
+	Path string
+	Min  uint64
+}
+
+type Options struct {
+	Space     []Space
+	MinMemory uint64 // bytes of MemAvailable; 0 skips the check
+	// Backend selects the repository configuration to read; empty skips
+	// the repository check.
+	Backend     string
+	RepoTimeout time.Duration
+}
+
+// Run performs all checks and returns their results in order. Paths that
+// do not exist are not checked.
+func Run(ctx context.Context, opt Options) []Check {
+	var checks []Check
+	for _, s := range opt.Space {
+		if s.Min == 0 {
+			continue
+		}
+		if c, ok := checkSpace(s); ok {
+			checks = append(checks, c)
+		}
+	}
+	if opt.MinMemory > 0 {
+		checks = append(checks, checkMemory(opt.MinMemory))
+	}
+	if opt.Backend != "" {
+		checks = append(checks, checkRepositories(ctx, opt.Backend, opt.RepoTimeout)...)
+	}
+	return checks
+}
+
+// Failed returns the checks that did not pass.
+func Failed(checks []Check) []Check {
+	var out []Check
+	for _, c := range checks {
+		if !c.OK {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+func checkSpace(s Space) (Check, bool) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(s.Path, &st); err != nil {
+		if os.IsNotExist(err) {
+			return Check{}, false
+		}
+		return Check{Name: "disk_space:" + s.Path, Detail: err.Error()}, true
+	}
+	free := st.Bavail * uint64(st.Bsize)
+	return Check{
+		Name:   "disk_space:" + s.Path,
+		OK:     free >= s.Min,
+		Detail: fmt.Sprintf("%s free, need %s", FormatBytes(free), FormatBytes(s.Min)),
+	}, true
+}
+
+func checkMemory(min uint64) Check {
+	c := Check{Name: "memory"}
+	avail, err := memAvailable()
+	if err != nil {
+		c.Detail = err.Error()
+		return c
+	}
+	c.OK = avail >= min
+	c.Detail = fmt.Sprintf("%s available, need %s", FormatBytes(avail), FormatBytes(min))
+	return c
+}
+
+// memAvailable reads MemAvailable from /proc/meminfo, in bytes.
+func memAvailable() (uint64, error) {
+	f, err := os.Open(filepath.Join(procDir, "meminfo"))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) >= 2 && fields[0] == "MemAvailable:" {
+			kb, err := strconv.ParseUint(fields[1], 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("parse MemAvailable: %w", err)
+			}
+			return kb * 1024, nil
+		}
+	}
+	return 0, fmt.Errorf("MemAvailable not found in %s", f.Name())
+}
+
+// FormatBytes renders n in binary units, e.g. "1.5 GiB".
+func FormatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
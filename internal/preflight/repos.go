@@ -0,0 +1,318 @@
+package preflight
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// repo is one configured repository; it is reachable if any of its URLs
+// is, since package managers fall back between mirrors.
+type repo struct {
+	name string
+	urls []string
+}
+
+var rootDir = "/"
+
+// repoReaders list the configured repositories of each backend.
+var repoReaders = map[string]func() []repo{
+	"apt":    aptRepos,
+	"dnf":    func() []repo { return iniRepos("etc/yum.repos.d", "baseurl", "mirrorlist", "metalink") },
+	"yum":    func() []repo { return iniRepos("etc/yum.repos.d", "baseurl", "mirrorlist", "metalink") },
+	"zypper": func() []repo { return iniRepos("etc/zypp/repos.d", "baseurl", "mirrorlist") },
+	"pacman": pacmanRepos,
+	"apk":    apkRepos,
+}
+
+func checkRepositories(ctx context.Context, backend string, timeout time.Duration) []Check {
+	read, ok := repoReaders[backend]
+	if !ok {
+		return nil
+	}
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	dialed := map[string]error{}
+	var checks []Check
+	for _, r := range read() {
+		c := Check{Name: "repository:" + r.name}
+		var problems []string
+		for _, raw := range r.urls {
+			where, err := reach(ctx, raw, timeout, dialed)
+			if err == nil {
+				c.OK = true
+				c.Detail = where
+				break
+			}
+			problems = append(problems, err.Error())
+		}
+		if !c.OK {
+			c.Detail = strings.Join(problems, "; ")
+		}
+		checks = append(checks, c)
+	}
+	return checks
+}
+
+// reach checks one repository URL: local mirrors must exist, remote ones
+// must accept a TCP connection (through the environment's proxy, if set).
+// Results are cached per address in dialed.
+func reach(ctx context.Context, raw string, timeout time.Duration, dialed map[string]error) (string, error) {
+	raw = strings.TrimPrefix(strings.TrimPrefix(raw, "mirror+"), "tor+")
+	if strings.HasPrefix(raw, "/") {
+		raw = "file://" + raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", raw, err)
+	}
+	var port string
+	switch u.Scheme {
+	case "file", "dir", "copy":
+		if _, err := os.Stat(u.Path); err != nil {
+			return "", fmt.Errorf("local mirror %s: %w", u.Path, err)
+		}
+		return "local mirror " + u.Path, nil
+	case "http", "mirror":
+		port = "80"
+	case "https":
+		port = "443"
+	case "ftp":
+		port = "21"
+	default:
+		// cdrom:, dvd:, plugin: and the like cannot be checked.
+		return "not checked (" + u.Scheme + ")", nil
+	}
+	if strings.Contains(u.Host, "$") {
+		return "not checked (host uses variables)", nil
+	}
+	if proxy, err := http.ProxyFromEnvironment(&http.Request{URL: u}); err == nil && proxy != nil {
+		u = proxy
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), port)
+	}
+	err, ok := dialed[addr]
+	if !ok {
+		d := net.Dialer{Timeout: timeout}
+		var conn net.Conn
+		if conn, err = d.DialContext(ctx, "tcp", addr); err == nil {
+			conn.Close()
+		}
+		dialed[addr] = err
+	}
+	if err != nil {
+		return "", fmt.Errorf("%s unreachable: %w", addr, err)
+	}
+	return addr + " reachable", nil
+}
+
+func aptRepos() []repo {
+	var repos []repo
+	files, _ := filepath.Glob(filepath.Join(rootDir, "etc/apt/sources.list.d/*.list"))
+	files = append([]string{filepath.Join(rootDir, "etc/apt/sources.list")}, files...)
+	for _, f := range files {
+		for _, line := range configLines(f) {
+			fields := strings.Fields(line)
+			if len(fields) < 2 || (fields[0] != "deb" && fields[0] != "deb-src") {
+				continue
+			}
+			fields = fields[1:]
+			// Skip "[arch=amd64 signed-by=...]" options.
+			if strings.HasPrefix(fields[0], "[") {
+				for len(fields) > 0 && !strings.HasSuffix(fields[0], "]") {
+					fields = fields[1:]
+				}
+				if len(fields) < 2 {
+					continue
+				}
+				fields = fields[1:]
+			}
+			repos = append(repos, repo{name: fields[0], urls: []string{fields[0]}})
+		}
+	}
+	// deb822 .sources files: stanzas with "URIs:" and optional "Enabled: no".
+	files, _ = filepath.Glob(filepath.Join(rootDir, "etc/apt/sources.list.d/*.sources"))
+	for _, f := range files {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			continue
+		}
+		for _, stanza := range strings.Split(string(b), "\n\n") {
+			var uris []string
+			enabled := true
+			for _, line := range strings.Split(stanza, "\n") {
+				k, v, ok := strings.Cut(line, ":")
+				if !ok || strings.HasPrefix(line, "#") {
+					continue
+				}
+				switch strings.ToLower(strings.TrimSpace(k)) {
+				case "uris":
+					uris = strings.Fields(v)
+				case "enabled":
+					enabled = strings.TrimSpace(strings.ToLower(v)) != "no"
+				}
+			}
+			if !enabled {
+				continue
+			}
+			for _, u := range uris {
+				repos = append(repos, repo{name: u, urls: []string{u}})
+			}
+		}
+	}
+	return dedupe(repos)
+}
+
+// iniRepos reads yum/dnf/zypper style .repo files: one [section] per
+// repository, skipped when enabled=0.
+func iniRepos(dir string, keys ...string) []repo {
+	files, _ := filepath.Glob(filepath.Join(rootDir, dir, "*.repo"))
+	var repos []repo
+	for _, f := range files {
+		var cur *repo
+		enabled := true
+		lastKey := ""
+		flush := func() {
+			if cur != nil && enabled && len(cur.urls) > 0 {
+				repos = append(repos, *cur)
+			}
+		}
+		for _, line := range rawLines(f) {
+			trimmed := strings.TrimSpace(line)
+			if trimmed == "" || strings.HasPrefix(trimmed, "#") || strings.HasPrefix(trimmed, ";") {
+				continue
+			}
+			if strings.HasPrefix(trimmed, "[") && strings.HasSuffix(trimmed, "]") {
+				flush()
+				cur = &repo{name: strings.Trim(trimmed, "[]")}
+				enabled = true
+				lastKey = ""
+				continue
+			}
+			if cur == nil {
+				continue
+			}
+			// Indented lines continue a multi-valued baseurl.
+			if line[0] == ' ' || line[0] == '\t' {
+				if lastKey != "" {
+					cur.urls = append(cur.urls, splitURLs(trimmed)...)
+				}
+				continue
+			}
+			k, v, ok := strings.Cut(trimmed, "=")
+			if !ok {
+				continue
+			}
+			k = strings.TrimSpace(k)
+			lastKey = ""
+			switch {
+			case k == "enabled":
+				enabled = strings.TrimSpace(v) != "0"
+			case contains(keys, k):
+				cur.urls = append(cur.urls, splitURLs(v)...)
+				lastKey = k
+			}
+		}
+		flush()
+	}
+	return repos
+}
+
+// pacmanRepos treats all Server lines as mirrors of one repository: pacman
+// tries them in turn.
+func pacmanRepos() []repo {
+	var urls []string
+	for _, f := range []string{"etc/pacman.conf", "etc/pacman.d/mirrorlist"} {
+		for _, line := range configLines(filepath.Join(rootDir, f)) {
+			k, v, ok := strings.Cut(line, "=")
+			if ok && strings.TrimSpace(k) == "Server" {
+				urls = append(urls, strings.TrimSpace(v))
+			}
+		}
+	}
+	if len(urls) == 0 {
+		return nil
+	}
+	return []repo{{name: "pacman mirrors", urls: urls}}
+}
+
+func apkRepos() []repo {
+	var repos []repo
+	for _, line := range configLines(filepath.Join(rootDir, "etc/apk/repositories")) {
+		fields := strings.Fields(line)
+		// "@tag url" pins a tagged repository.
+		if strings.HasPrefix(fields[0], "@") {
+			if len(fields) < 2 {
+				continue
+			}
+			fields = fields[1:]
+		}
+		repos = append(repos, repo{name: fields[0], urls: []string{fields[0]}})
+	}
+	return repos
+}
+
+// configLines returns the non-empty, non-comment lines of path, trimmed.
+func configLines(path string) []string {
+	var out []string
+	for _, line := range rawLines(path) {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			out = append(out, line)
+		}
+	}
+	return out
+}
+
+func rawLines(path string) []string {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var out []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		out = append(out, sc.Text())
+	}
+	return out
+}
+
+func splitURLs(v string) []string {
+	return strings.FieldsFunc(v, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' })
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func dedupe(repos []repo) []repo {
+	seen := map[string]bool{}
+	var out []repo
+	for _, r := range repos {
+		if !seen[r.name] {
+			seen[r.name] = true
+			out = append(out, r)
+		}
+	}
+	return out
+}
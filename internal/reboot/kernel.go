@@ -0,0 +1,85 @@
+package reboot
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/serverpatcher/serverpatcher/internal/pkgver"
+)
+
+var (
+	osReleasePath = "/proc/sys/kernel/osrelease"
+	bootDir       = "/boot"
+	modulesDir    = "/lib/modules"
+)
+
+// RunningKernel returns the release of the running kernel, as `uname -r`.
+func RunningKernel() (string, error) {
+	b, err := os.ReadFile(osReleasePath)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// InstalledKernels returns the releases of kernels present on disk, taken
+// from versioned images in /boot and from module trees that depmod has
+// indexed. Unversioned images (Arch, Alpine) are covered by their modules.
+func InstalledKernels() []string {
+	seen := map[string]bool{}
+	var out []string
+	add := func(v string) {
+		if v != "" && v[0] >= '0' && v[0] <= '9' && !seen[v] {
+			seen[v] = true
+			out = append(out, v)
+		}
+	}
+
+	for _, prefix := range []string{"vmlinuz-", "vmlinux-", "Image-"} {
+		matches, _ := filepath.Glob(filepath.Join(bootDir, prefix+"*"))
+		for _, m := range matches {
+			add(strings.TrimPrefix(filepath.Base(m), prefix))
+		}
+	}
+
+	entries, _ := os.ReadDir(modulesDir)
+	for _, e := range entries {
+		dir := filepath.Join(modulesDir, e.Name())
+		// Directories without modules.dep are leftovers of removed kernels.
+		if _, err := os.Stat(filepath.Join(dir, "modules.dep")); err == nil {
+			add(e.Name())
+		}
+	}
+	return out
+}
+
+func kernelCheck() (bool, string) {
+	running, err := RunningKernel()
+	if err != nil {
+		return false, ""
+	}
+	installed := InstalledKernels()
+	if len(installed) == 0 {
+		// Containers and some VMs have no kernel on disk.
+		return false, ""
+	}
+
+	newest := ""
+	present := false
+	for _, k := range installed {
+		if k == running {
+			present = true
+		}
+		if newest == "" || pkgver.Compare(k, newest) > 0 {
+			newest = k
+		}
+	}
+	if pkgver.Compare(newest, running) > 0 {
+		return true, "newer kernel installed: " + newest + " (running " + running + ")"
+	}
+	if !present {
+		return true, "running kernel " + running + " is no longer installed"
+	}
+	return false, ""
+}
@@ -0,0 +1,78 @@
+package reboot
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var procDir = "/proc"
+
+// Process is a running process that maps files which were deleted or
+// replaced on disk since it started.
+type Process struct {
+	PID   int      `json:"pid"`
+	Comm  string   `json:"comm"`
+	Files []string `json:"files"`
+}
+
+// DeletedMappings scans /proc/*/maps for file mappings marked "(deleted)"
+// whose path satisfies match. Processes that vanish or cannot be read
+// (permissions, kernel threads) are skipped.
+func DeletedMappings(match func(path string) bool) ([]Process, error) {
+	entries, err := os.ReadDir(procDir)
+	if err != nil {
+		return nil, err
+	}
+	var procs []Process
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		files := deletedFiles(filepath.Join(procDir, e.Name(), "maps"), match)
+		if len(files) == 0 {
+			continue
+		}
+		comm, _ := os.ReadFile(filepath.Join(procDir, e.Name(), "comm"))
+		procs = append(procs, Process{PID: pid, Comm: strings.TrimSpace(string(comm)), Files: files})
+	}
+	sort.Slice(procs, func(i, j int) bool { return procs[i].PID < procs[j].PID })
+	return procs, nil
+}
+
+func deletedFiles(mapsPath string, match func(string) bool) []string {
+	f, err := os.Open(mapsPath)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	seen := map[string]bool{}
+	var files []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := sc.Text()
+		if !strings.HasSuffix(line, " (deleted)") {
+			continue
+		}
+		// address perms offset dev inode path (deleted)
+		fields := strings.Fields(strings.TrimSuffix(line, " (deleted)"))
+		if len(fields) < 6 {
+			continue
+		}
+		path := strings.Join(fields[5:], " ")
+		if !strings.HasPrefix(path, "/") || strings.HasPrefix(path, "/dev/") || strings.HasPrefix(path, "/memfd:") {
+			continue
+		}
+		if seen[path] || !match(path) {
+			continue
+		}
+		seen[path] = true
+		files = append(files, path)
+	}
+	return files
+}
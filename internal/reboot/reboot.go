@@ -0,0 +1,71 @@
+// Package reboot detects whether a host must be rebooted to actually run the
+// software that is installed on disk. It only looks at the kernel and /proc,
+// so it works the same on every distribution.
+package reboot
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+type Result struct {
+	Required bool     `json:"required"`
+	Reasons  []string `json:"reasons,omitempty"`
+}
+
+func (r Result) Reason() string {
+	return strings.Join(r.Reasons, "; ")
+}
+
+// Check runs the kernel and core-library checks. Errors reading the system
+// make a check inconclusive rather than failing the whole result.
+func Check() Result {
+	var res Result
+	if ok, reason := kernelCheck(); ok {
+		res.Required = true
+		res.Reasons = append(res.Reasons, reason)
+	}
+	if ok, reason := coreLibraryCheck(); ok {
+		res.Required = true
+		res.Reasons = append(res.Reasons, reason)
+	}
+	return res
+}
+
+// coreLibraries match the basenames of libraries whose stale copies can
+// only be dropped from every process by rebooting (PID 1 maps all of them).
+var coreLibraries = []string{
+	"libc.so", "libc-", "ld-linux", "ld-musl", "libpthread",
+	"libsystemd", "libudev",
+	"libssl.so", "libcrypto.so",
+}
+
+func isCoreLibrary(path string) bool {
+	base := path[strings.LastIndex(path, "/")+1:]
+	for _, prefix := range coreLibraries {
+		if strings.HasPrefix(base, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func coreLibraryCheck() (bool, string) {
+	procs, err := DeletedMappings(isCoreLibrary)
+	if err != nil || len(procs) == 0 {
+		return false, ""
+	}
+	counts := map[string]int{}
+	for _, p := range procs {
+		for _, f := range p.Files {
+			counts[f[strings.LastIndex(f, "/")+1:]]++
+		}
+	}
+	libs := make([]string, 0, len(counts))
+	for lib, n := range counts {
+		libs = append(libs, fmt.Sprintf("%s (%d processes)", lib, n))
+	}
+	sort.Strings(libs)
+	return true, "updated core libraries still in use: " + strings.Join(libs, ", ")
+}
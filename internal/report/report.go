@@ -7,7 +7,11 @@ import (
 	"path/filepath"
 	"time"
 
+	"github.com/serverpatcher/serverpatcher/internal/lock"
 	"github.com/serverpatcher/serverpatcher/internal/patcher"
+	"github.com/serverpatcher/serverpatcher/internal/preflight"
+	"github.com/serverpatcher/serverpatcher/internal/services"
+	"github.com/serverpatcher/serverpatcher/internal/snapshot"
 )
 
 type Status string
@@ -16,23 +20,85 @@ const (
 	StatusSuccess Status = "success"
 	StatusFailed  Status = "failed"
 	StatusSkipped Status = "skipped"
+	// StatusPartial means the distro backend succeeded but at least one
+	// secondary source failed.
+	StatusPartial Status = "partial"
 )
 
+// ReasonPreflightFailed marks a run skipped because a preflight check
+// failed; the failing checks are in Preflight.
+const ReasonPreflightFailed = "preflight_failed"
+
+// ReasonWindowClosing marks a daemon run deferred because too little of
+// its maintenance window was left.
+const ReasonWindowClosing = "window_closing"
+
+// SourceReport is the result of one secondary package source.
+type SourceReport struct {
+	Source         string                  `json:"source"`
+	Status         Status                  `json:"status"`
+	Patched        bool                    `json:"patched"`
+	RebootRequired bool                    `json:"reboot_required"`
+	RebootReason   string                  `json:"reboot_reason,omitempty"`
+	Changes        []patcher.PackageChange `json:"changes"`
+	Plan           []patcher.PackageChange `json:"plan,omitempty"` // dry runs only
+	Steps          []patcher.Step          `json:"steps"`
+	Category       patcher.Category        `json:"category,omitempty"`
+	Error          string                  `json:"error,omitempty"`
+}
+
+// RollbackInfo describes a rollback run: which report it undoes, the
+// versions it targets and the changes it leaves alone.
+type RollbackInfo struct {
+	Of      string                   `json:"of"`
+	Targets []patcher.PackageVersion `json:"targets"`
+	Skipped []patcher.PackageChange  `json:"skipped,omitempty"`
+}
+
+// CleanupReport is the post-patch cleanup: packages it removed and the
+// disk space freed on /, /var, /boot and the package cache.
+type CleanupReport struct {
+	BytesFreed uint64                  `json:"bytes_freed"`
+	Removed    []patcher.PackageChange `json:"removed"`
+	Steps      []patcher.Step          `json:"steps"`
+	Error      string                  `json:"error,omitempty"`
+}
+
 type Report struct {
-	App            string         `json:"app"`
-	Hostname       string         `json:"hostname"`
-	Started        time.Time      `json:"started"`
-	Ended          time.Time      `json:"ended"`
-	Duration       time.Duration  `json:"duration"`
-	Status         Status         `json:"status"`
-	Patched        bool           `json:"patched"`
-	Backend        string         `json:"backend"`
-	RebootRequired bool           `json:"reboot_required"`
-	RebootReason   string         `json:"reboot_reason,omitempty"`
-	OS             any            `json:"os"`
-	Steps          []patcher.Step `json:"steps"`
-	Error          string         `json:"error,omitempty"`
-	ReportPath     string         `json:"-"`
+	App             string                  `json:"app"`
+	Operation       string                  `json:"operation,omitempty"` // empty for patch runs
+	Hostname        string                  `json:"hostname"`
+	Started         time.Time               `json:"started"`
+	Ended           time.Time               `json:"ended"`
+	Duration        time.Duration           `json:"duration"`
+	Status          Status                  `json:"status"`
+	Reason          string                  `json:"reason,omitempty"`
+	Patched         bool                    `json:"patched"`
+	Backend         string                  `json:"backend"`
+	RebootRequired  bool                    `json:"reboot_required"`
+	RebootReason    string                  `json:"reboot_reason,omitempty"`
+	OS              any                     `json:"os"`
+	IncludePackages []string                `json:"include_packages,omitempty"`
+	SecurityFilter  string                  `json:"security_filter,omitempty"`
+	HeldBack        []patcher.HeldBack      `json:"held_back,omitempty"` // patching.min_package_age
+	Changes         []patcher.PackageChange `json:"changes"`
+	Reverted        []patcher.PackageChange `json:"reverted_changes,omitempty"` // undone by a snapshot rollback
+	Plan            []patcher.PackageChange `json:"plan,omitempty"`             // dry runs only
+	AppliedPatches  []string                `json:"applied_patches,omitempty"`
+	CVEs            []string                `json:"cves,omitempty"` // fixed by Changes (planned by Plan in dry runs)
+	Services        []services.Affected     `json:"services,omitempty"`
+	Cleanup         *CleanupReport          `json:"cleanup,omitempty"`
+	Sources         []SourceReport          `json:"sources,omitempty"`
+	Preflight       []preflight.Check       `json:"preflight,omitempty"`
+	LockWait        time.Duration           `json:"lock_wait,omitempty"`
+	LockHolders     []lock.Holder           `json:"lock_holders,omitempty"`
+	Snapshot        *snapshot.Snapshot      `json:"snapshot,omitempty"`
+	Rollback        *RollbackInfo           `json:"rollback,omitempty"`
+	PlanFile        string                  `json:"plan_file,omitempty"` // apply runs only
+	Steps           []patcher.Step          `json:"steps"`
+	FailureCategory patcher.Category        `json:"failure_category,omitempty"`
+	Error           string                  `json:"error,omitempty"`
+	ReportPath      string                  `json:"-"`
 }
 
 func (r *Report) ToJSON() ([]byte, error) {
@@ -44,7 +110,11 @@ func WriteJSON(dir string, r *Report) (string, error) {
 		return "", err
 	}
 	ts := r.Started.UTC().Format("20060102T150405Z")
-	name := fmt.Sprintf("report_%s_%s.json", r.Hostname, ts)
+	prefix := "report"
+	if r.Operation != "" {
+		prefix = r.Operation
+	}
+	name := fmt.Sprintf("%s_%s_%s.json", prefix, r.Hostname, ts)
 	path := filepath.Join(dir, name)
 	b, err := r.ToJSON()
 	if err != nil {
@@ -56,6 +126,19 @@ func WriteJSON(dir string, r *Report) (string, error) {
 	return path, nil
 }
 
+func ReadJSON(path string) (*Report, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var r Report
+	if err := json.Unmarshal(b, &r); err != nil {
+		return nil, fmt.Errorf("parse report %s: %w", path, err)
+	}
+	r.ReportPath = path
+	return &r, nil
+}
+
 func PurgeOld(dir string, retainDays int) error {
 	if retainDays <= 0 {
 		return nil
@@ -0,0 +1,135 @@
+package schedule
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronExpr is a standard five-field cron expression: minute, hour, day of
+// month, month, day of week.
+type cronExpr struct {
+	minute, hour, dom, month, dow uint64 // bit sets
+	// Like cron, a restricted day of month and day of week match when
+	// either does.
+	domStar, dowStar bool
+}
+
+var monthNames = map[string]int{"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6, "jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12}
+
+func parseCron(f []string) (*cronExpr, error) {
+	c := &cronExpr{domStar: f[2] == "*", dowStar: f[4] == "*"}
+	var err error
+	for _, field := range []struct {
+		dst      *uint64
+		s        string
+		min, max int
+		names    map[string]int
+	}{
+		{&c.minute, f[0], 0, 59, nil},
+		{&c.hour, f[1], 0, 23, nil},
+		{&c.dom, f[2], 1, 31, nil},
+		{&c.month, f[3], 1, 12, monthNames},
+		{&c.dow, f[4], 0, 7, dayNames},
+	} {
+		if *field.dst, err = parseCronField(field.s, field.min, field.max, field.names); err != nil {
+			return nil, err
+		}
+	}
+	// 7 is Sunday too.
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	return c, nil
+}
+
+// parseCronField reads "*", "a", "a-b", "*/n", "a-b/n" and comma lists of
+// them into a bit set.
+func parseCronField(s string, min, max int, names map[string]int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(s, ",") {
+		rng, stepStr, stepped := strings.Cut(part, "/")
+		step := 1
+		if stepped {
+			n, err := strconv.Atoi(stepStr)
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid cron step %q", part)
+			}
+			step = n
+		}
+		lo, hi := min, max
+		if rng != "*" {
+			a, b, ranged := strings.Cut(rng, "-")
+			var err error
+			if lo, err = cronValue(a, names); err != nil {
+				return 0, err
+			}
+			hi = lo
+			if ranged {
+				if hi, err = cronValue(b, names); err != nil {
+					return 0, err
+				}
+			} else if stepped {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("cron field %q out of range %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func cronValue(s string, names map[string]int) (int, error) {
+	if v, ok := names[strings.ToLower(s)]; ok {
+		return v, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid cron value %q", s)
+	}
+	return v, nil
+}
+
+func (c *cronExpr) dayMatches(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	switch {
+	case c.domStar && c.dowStar:
+		return true
+	case c.domStar:
+		return dow
+	case c.dowStar:
+		return dom
+	}
+	return dom || dow
+}
+
+// next returns the first matching minute at or after t, searching up to
+// five years ahead (an expression such as "0 0 30 2 *" never matches).
+func (c *cronExpr) next(t time.Time) time.Time {
+	loc := t.Location()
+	if t.Second() != 0 || t.Nanosecond() != 0 {
+		t = t.Truncate(time.Minute).Add(time.Minute)
+	}
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case c.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+		case !c.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+		case c.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return limit
+}
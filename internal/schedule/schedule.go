@@ -0,0 +1,225 @@
+// Package schedule parses maintenance windows and finds their occurrences.
+//
+// A window is written either calendar style,
+//
+//	Tue,Thu 02:00-04:00 Europe/Zagreb
+//	Mon..Fri 22:00 3h
+//	*-*-* 01:30-02:30 UTC
+//
+// with optional weekdays (Mon,Tue or ranges Mon..Fri and Mon-Fri; omitted
+// or "*" means daily), a start time followed by an end time or a duration,
+// and an optional IANA time zone; or as a five-field cron expression for
+// the start followed by a duration and an optional time zone:
+//
+//	30 2 * * 2,4 90m Europe/Zagreb
+//
+// Without a time zone the local one is used. Windows may cross midnight.
+package schedule
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Window struct {
+	spec string
+	loc  *time.Location
+	dur  time.Duration
+
+	// Calendar windows.
+	days  [7]bool
+	start int // minutes after midnight
+
+	// Cron windows.
+	cron *cronExpr
+}
+
+func Parse(spec string) (*Window, error) {
+	f := strings.Fields(spec)
+	w := &Window{spec: spec, loc: time.Local}
+	var err error
+	if len(f) >= 6 {
+		if w.cron, err = parseCron(f[:5]); err != nil {
+			return nil, fmt.Errorf("window %q: %w", spec, err)
+		}
+		if now := time.Now(); !w.cron.next(now).Before(now.AddDate(5, 0, 0)) {
+			return nil, fmt.Errorf("window %q: cron expression never matches", spec)
+		}
+		f = f[5:]
+		if w.dur, err = time.ParseDuration(f[0]); err != nil || w.dur <= 0 {
+			return nil, fmt.Errorf("window %q: invalid duration %q", spec, f[0])
+		}
+		f = f[1:]
+	} else {
+		if len(f) > 0 && !strings.Contains(f[0], ":") {
+			if w.days, err = parseDays(f[0]); err != nil {
+				return nil, fmt.Errorf("window %q: %w", spec, err)
+			}
+			f = f[1:]
+		} else {
+			w.days = [7]bool{true, true, true, true, true, true, true}
+		}
+		if len(f) == 0 {
+			return nil, fmt.Errorf("window %q: missing start time", spec)
+		}
+		startStr, endStr, ranged := strings.Cut(f[0], "-")
+		if w.start, err = parseClock(startStr); err != nil {
+			return nil, fmt.Errorf("window %q: %w", spec, err)
+		}
+		f = f[1:]
+		if ranged {
+			end, err := parseClock(endStr)
+			if err != nil {
+				return nil, fmt.Errorf("window %q: %w", spec, err)
+			}
+			if end == w.start {
+				return nil, fmt.Errorf("window %q: start and end are the same", spec)
+			}
+			if end < w.start {
+				end += 24 * 60
+			}
+			w.dur = time.Duration(end-w.start) * time.Minute
+		} else {
+			if len(f) == 0 {
+				return nil, fmt.Errorf("window %q: missing end time or duration", spec)
+			}
+			if w.dur, err = time.ParseDuration(f[0]); err != nil || w.dur <= 0 {
+				return nil, fmt.Errorf("window %q: invalid duration %q", spec, f[0])
+			}
+			f = f[1:]
+		}
+	}
+	if len(f) > 1 {
+		return nil, fmt.Errorf("window %q: unexpected %q", spec, strings.Join(f[1:], " "))
+	}
+	if len(f) == 1 {
+		if w.loc, err = time.LoadLocation(f[0]); err != nil {
+			return nil, fmt.Errorf("window %q: time zone: %w", spec, err)
+		}
+	}
+	return w, nil
+}
+
+func (w *Window) String() string { return w.spec }
+
+// Next returns the occurrence of w that contains t, or else the first one
+// starting after t.
+func (w *Window) Next(t time.Time) (start, end time.Time) {
+	start = w.nextStart(t.Add(-w.dur))
+	for !start.Add(w.dur).After(t) {
+		start = w.nextStart(start.Add(time.Minute))
+	}
+	return start, start.Add(w.dur)
+}
+
+// nextStart returns the first start at or after t.
+func (w *Window) nextStart(t time.Time) time.Time {
+	t = t.In(w.loc)
+	if w.cron != nil {
+		return w.cron.next(t)
+	}
+	for d := 0; d <= 7; d++ {
+		day := time.Date(t.Year(), t.Month(), t.Day()+d, 0, 0, 0, 0, w.loc)
+		s := time.Date(day.Year(), day.Month(), day.Day(), w.start/60, w.start%60, 0, 0, w.loc)
+		if w.days[day.Weekday()] && !s.Before(t) {
+			return s
+		}
+	}
+	// parseDays guarantees at least one day, so this is unreachable.
+	return t
+}
+
+// Windows is a set of maintenance windows; runs may start in any of them.
+type Windows []*Window
+
+func ParseAll(specs []string) (Windows, error) {
+	var ws Windows
+	for _, s := range specs {
+		w, err := Parse(s)
+		if err != nil {
+			return nil, err
+		}
+		ws = append(ws, w)
+	}
+	return ws, nil
+}
+
+// Next returns the window occurrence containing t that ends last, or else
+// the one starting soonest after t. ok is false when ws is empty.
+func (ws Windows) Next(t time.Time) (start, end time.Time, ok bool) {
+	for _, w := range ws {
+		s, e := w.Next(t)
+		if !ok || better(t, s, e, start, end) {
+			start, end, ok = s, e, true
+		}
+	}
+	return start, end, ok
+}
+
+// better reports whether occurrence s-e is preferable to cs-ce at t: an
+// open window beats a future one, a later end among open ones and an
+// earlier start among future ones.
+func better(t, s, e, cs, ce time.Time) bool {
+	open, curOpen := !s.After(t), !cs.After(t)
+	if open != curOpen {
+		return open
+	}
+	if open {
+		return e.After(ce)
+	}
+	return s.Before(cs)
+}
+
+var dayNames = map[string]int{"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6}
+
+// parseDays reads "Mon,Wed", "Mon..Fri", "Mon-Fri" or "*". A leading
+// systemd date part such as "*-*-*" is accepted as "every day".
+func parseDays(s string) ([7]bool, error) {
+	var days [7]bool
+	if s == "*" || s == "*-*-*" {
+		return [7]bool{true, true, true, true, true, true, true}, nil
+	}
+	for _, part := range strings.Split(s, ",") {
+		from, to, ranged := strings.Cut(part, "..")
+		if !ranged {
+			from, to, ranged = strings.Cut(part, "-")
+		}
+		a, ok := dayNames[strings.ToLower(prefix3(from))]
+		if !ok {
+			return days, fmt.Errorf("invalid weekday %q", from)
+		}
+		b := a
+		if ranged {
+			if b, ok = dayNames[strings.ToLower(prefix3(to))]; !ok {
+				return days, fmt.Errorf("invalid weekday %q", to)
+			}
+		}
+		for d := a; ; d = (d + 1) % 7 {
+			days[d] = true
+			if d == b {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+func prefix3(s string) string {
+	if len(s) > 3 {
+		return s[:3]
+	}
+	return s
+}
+
+// parseClock reads HH:MM into minutes after midnight.
+func parseClock(s string) (int, error) {
+	h, m, ok := strings.Cut(s, ":")
+	hh, err1 := strconv.Atoi(h)
+	mm, err2 := strconv.Atoi(m)
+	if !ok || err1 != nil || err2 != nil || hh < 0 || hh > 23 || mm < 0 || mm > 59 {
+		return 0, fmt.Errorf("invalid time %q (expected HH:MM)", s)
+	}
+	return hh*60 + mm, nil
+}
@@ -0,0 +1,136 @@
+// Package services finds systemd services whose processes still run code
+// that was replaced on disk by an upgrade, and restarts them on request.
+package services
+
+import (
+	"context"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/serverpatcher/serverpatcher/internal/executil"
+	"github.com/serverpatcher/serverpatcher/internal/reboot"
+)
+
+type Action string
+
+const (
+	ActionReported  Action = "reported"
+	ActionRestarted Action = "restarted"
+	ActionDenied    Action = "denied"
+	ActionFailed    Action = "failed"
+)
+
+type Affected struct {
+	Unit   string   `json:"unit"`
+	PIDs   []int    `json:"pids"`
+	Files  []string `json:"files"`
+	Action Action   `json:"action"`
+	Error  string   `json:"error,omitempty"`
+}
+
+var procDir = "/proc"
+
+// packagedPrefixes are where package managers install code. Deleted files
+// elsewhere (/tmp, /dev/shm, memfd) are application state, not upgrades.
+var packagedPrefixes = []string{"/usr/", "/lib/", "/lib64/", "/bin/", "/sbin/", "/opt/"}
+
+func isPackagedFile(p string) bool {
+	for _, prefix := range packagedPrefixes {
+		if strings.HasPrefix(p, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// FindAffected maps processes that still use deleted packaged files back to
+// the system services they belong to. Processes outside system.slice (user
+// sessions, containers) are ignored.
+func FindAffected() ([]Affected, error) {
+	procs, err := reboot.DeletedMappings(isPackagedFile)
+	if err != nil {
+		return nil, err
+	}
+	byUnit := map[string]*Affected{}
+	for _, p := range procs {
+		unit := unitOf(p.PID)
+		if unit == "" {
+			continue
+		}
+		a := byUnit[unit]
+		if a == nil {
+			a = &Affected{Unit: unit, Action: ActionReported}
+			byUnit[unit] = a
+		}
+		a.PIDs = append(a.PIDs, p.PID)
+		for _, f := range p.Files {
+			if !contains(a.Files, f) {
+				a.Files = append(a.Files, f)
+			}
+		}
+	}
+
+	out := make([]Affected, 0, len(byUnit))
+	for _, a := range byUnit {
+		sort.Strings(a.Files)
+		out = append(out, *a)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Unit < out[j].Unit })
+	return out, nil
+}
+
+// unitOf returns the system service owning pid, read from its cgroup path
+// (e.g. "0::/system.slice/nginx.service").
+func unitOf(pid int) string {
+	b, err := os.ReadFile(filepath.Join(procDir, strconv.Itoa(pid), "cgroup"))
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) != 3 || !strings.HasPrefix(parts[2], "/system.slice/") {
+			continue
+		}
+		for _, c := range strings.Split(parts[2], "/") {
+			if strings.HasSuffix(c, ".service") {
+				return c
+			}
+		}
+	}
+	return ""
+}
+
+// Allowed applies the allow/deny lists (shell-style patterns). An empty
+// allow list allows every unit; deny always wins.
+func Allowed(unit string, allow, deny []string) bool {
+	if matchAny(unit, deny) {
+		return false
+	}
+	return len(allow) == 0 || matchAny(unit, allow)
+}
+
+func Restart(ctx context.Context, unit string) (*executil.Result, error) {
+	return executil.Run(ctx, "systemctl", "restart", unit)
+}
+
+func matchAny(name string, patterns []string) bool {
+	for _, pat := range patterns {
+		if ok, _ := path.Match(pat, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
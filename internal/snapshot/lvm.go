@@ -0,0 +1,52 @@
+package snapshot
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/serverpatcher/serverpatcher/internal/executil"
+)
+
+func init() {
+	Register("lvm", func(target string) (Provider, error) {
+		vg, lv, ok := strings.Cut(target, "/")
+		if !ok || vg == "" || lv == "" {
+			return nil, fmt.Errorf("lvm snapshot target must be vg/lv, got %q", target)
+		}
+		return &LVM{VG: vg, LV: lv}, nil
+	})
+}
+
+// LVM snapshots a thin logical volume. Thin snapshots need no size and
+// share the pool with their origin.
+type LVM struct {
+	VG string
+	LV string
+}
+
+func (p *LVM) Name() string { return "lvm" }
+
+func (p *LVM) Create(ctx context.Context, name string) (*Snapshot, *executil.Result, error) {
+	r, err := executil.Run(ctx, "lvcreate", "--snapshot", "--name", name, p.VG+"/"+p.LV)
+	if err != nil {
+		return nil, r, err
+	}
+	return &Snapshot{Provider: p.Name(), Target: p.VG + "/" + p.LV, Name: name, Created: time.Now()}, r, nil
+}
+
+func (p *LVM) Delete(ctx context.Context, s *Snapshot) (*executil.Result, error) {
+	return executil.Run(ctx, "lvremove", "--yes", p.VG+"/"+s.Name)
+}
+
+// Rollback merges the snapshot back into its origin. If the origin is in
+// use, LVM defers the merge to the next activation, i.e. the next boot.
+func (p *LVM) Rollback(ctx context.Context, s *Snapshot) (*executil.Result, error) {
+	r, err := executil.Run(ctx, "lvconvert", "--merge", p.VG+"/"+s.Name)
+	if err == nil && r != nil {
+		out := strings.ToLower(r.Stdout + r.Stderr)
+		s.RebootRequired = strings.Contains(out, "delaying merge") || strings.Contains(out, "next activation")
+	}
+	return r, err
+}
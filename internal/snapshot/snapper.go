@@ -0,0 +1,55 @@
+package snapshot
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/serverpatcher/serverpatcher/internal/executil"
+)
+
+func init() {
+	Register("snapper", func(target string) (Provider, error) {
+		if target == "" {
+			target = "root"
+		}
+		return &Snapper{Config: target}, nil
+	})
+}
+
+// Snapper snapshots a btrfs subvolume through a snapper config.
+type Snapper struct {
+	Config string
+}
+
+func (p *Snapper) Name() string { return "snapper" }
+
+func (p *Snapper) Create(ctx context.Context, name string) (*Snapshot, *executil.Result, error) {
+	r, err := executil.Run(ctx, "snapper", "-c", p.Config, "create",
+		"--type", "single", "--cleanup-algorithm", "number", "--print-number", "--description", name)
+	if err != nil {
+		return nil, r, err
+	}
+	id := strings.TrimSpace(r.Stdout)
+	if id == "" {
+		return nil, r, fmt.Errorf("snapper did not print a snapshot number")
+	}
+	return &Snapshot{Provider: p.Name(), Target: p.Config, Name: name, ID: id, Created: time.Now()}, r, nil
+}
+
+func (p *Snapper) Delete(ctx context.Context, s *Snapshot) (*executil.Result, error) {
+	return executil.Run(ctx, "snapper", "-c", p.Config, "delete", s.ID)
+}
+
+// Rollback uses `snapper rollback` for the root config, which makes the
+// snapshot the default subvolume for the next boot. Other configs are
+// restored in place with undochange.
+func (p *Snapper) Rollback(ctx context.Context, s *Snapshot) (*executil.Result, error) {
+	if p.Config == "root" {
+		r, err := executil.Run(ctx, "snapper", "-c", p.Config, "rollback", s.ID)
+		s.RebootRequired = err == nil
+		return r, err
+	}
+	return executil.Run(ctx, "snapper", "-c", p.Config, "undochange", s.ID+"..0")
+}
@@ -0,0 +1,75 @@
+// Package snapshot takes filesystem snapshots before patching so that a
+// failed run can be rolled back. Providers register themselves by name; a
+// provider only needs to create, delete and roll back a snapshot of one
+// target (an LVM volume, a snapper config, a ZFS dataset).
+package snapshot
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/serverpatcher/serverpatcher/internal/executil"
+)
+
+type Decision string
+
+const (
+	DecisionKept           Decision = "kept"
+	DecisionDiscarded      Decision = "discarded"
+	DecisionRolledBack     Decision = "rolled_back"
+	DecisionRollbackFailed Decision = "rollback_failed"
+)
+
+type Snapshot struct {
+	Provider string    `json:"provider"`
+	Target   string    `json:"target"`
+	Name     string    `json:"name"`
+	ID       string    `json:"id,omitempty"` // provider-specific handle, e.g. the snapper number
+	Created  time.Time `json:"created"`
+	Decision Decision  `json:"decision,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	// RebootRequired is set by Rollback when the restored state only takes
+	// effect after a reboot.
+	RebootRequired bool `json:"reboot_required,omitempty"`
+}
+
+// Provider snapshots a single target. Methods return the command result so
+// callers can record it as a report step.
+type Provider interface {
+	Name() string
+	Create(ctx context.Context, name string) (*Snapshot, *executil.Result, error)
+	Delete(ctx context.Context, s *Snapshot) (*executil.Result, error)
+	// Rollback restores the target to s and sets s.RebootRequired when the
+	// restored state only takes effect after a reboot.
+	Rollback(ctx context.Context, s *Snapshot) (*executil.Result, error)
+}
+
+// Factory builds a provider for a target as configured in snapshot.target.
+type Factory func(target string) (Provider, error)
+
+var factories = map[string]Factory{}
+
+// Register makes a provider available to New. It is called from init by
+// the built-in providers and may be used to plug in others.
+func Register(name string, f Factory) {
+	factories[name] = f
+}
+
+func New(name, target string) (Provider, error) {
+	f, ok := factories[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown snapshot provider %q (available: %v)", name, Providers())
+	}
+	return f(target)
+}
+
+func Providers() []string {
+	names := make([]string, 0, len(factories))
+	for n := range factories {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,42 @@
+package snapshot
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/serverpatcher/serverpatcher/internal/executil"
+)
+
+func init() {
+	Register("zfs", func(target string) (Provider, error) {
+		if target == "" {
+			return nil, fmt.Errorf("zfs snapshot target must be a dataset, e.g. rpool/ROOT/debian")
+		}
+		return &ZFS{Dataset: target}, nil
+	})
+}
+
+// ZFS snapshots a single dataset.
+type ZFS struct {
+	Dataset string
+}
+
+func (p *ZFS) Name() string { return "zfs" }
+
+func (p *ZFS) Create(ctx context.Context, name string) (*Snapshot, *executil.Result, error) {
+	r, err := executil.Run(ctx, "zfs", "snapshot", p.Dataset+"@"+name)
+	if err != nil {
+		return nil, r, err
+	}
+	return &Snapshot{Provider: p.Name(), Target: p.Dataset, Name: name, Created: time.Now()}, r, nil
+}
+
+func (p *ZFS) Delete(ctx context.Context, s *Snapshot) (*executil.Result, error) {
+	return executil.Run(ctx, "zfs", "destroy", p.Dataset+"@"+s.Name)
+}
+
+// Rollback is immediate. -r discards any snapshots taken after s.
+func (p *ZFS) Rollback(ctx context.Context, s *Snapshot) (*executil.Result, error) {
+	return executil.Run(ctx, "zfs", "rollback", "-r", p.Dataset+"@"+s.Name)
+}